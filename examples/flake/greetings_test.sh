@@ -0,0 +1,4 @@
+#!/usr/bin/env bash
+set -euo pipefail
+
+grep -q "Hello, world!" "$1"
@@ -0,0 +1,22 @@
+{
+  description = "Tools built from a flake, without default.nix";
+
+  outputs = {self}: let
+    srcDef = builtins.fromJSON (builtins.readFile ./nixpkgs.json);
+    nixpkgs = builtins.fetchTarball {
+      url = srcDef.url;
+      sha256 = srcDef.sha256;
+    };
+    systems = ["x86_64-linux" "aarch64-linux" "x86_64-darwin" "aarch64-darwin"];
+    forAllSystems = f:
+      builtins.listToAttrs (map (system: {
+          name = system;
+          value = f (import nixpkgs {inherit system;});
+        })
+        systems);
+  in {
+    packages = forAllSystems (pkgs: {
+      inherit (pkgs) cowsay hello;
+    });
+  };
+}
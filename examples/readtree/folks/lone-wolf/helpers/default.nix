@@ -0,0 +1,4 @@
+{pkgs}:
+pkgs.writeShellScriptBin "helpers" ''
+  echo "readPkgs stops at lone-wolf, so nobody can reach me"
+''
@@ -0,0 +1,142 @@
+package gazelle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// traceCacheEntry is a cached evaluation: its trace, the derivations it
+// imported from, and the content hashes of the files it read, or failed
+// to find, when it was recorded. The entry is valid as long as these
+// files are unchanged.
+type traceCacheEntry struct {
+	Inputs map[string]string
+	Trace  TraceOuts
+	IFD    []string
+}
+
+// traceCacheKey identifies an evaluation by its command, its
+// environment, and the tracer recording it.
+func traceCacheKey(t tracer, args []string, env []string) string {
+	h := sha256.New()
+	for _, part := range [][]string{{t.path()}, args, env} {
+		h.Write([]byte(strings.Join(part, "\x00")))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashFile returns the content hash of the file, or "" when it cannot be
+// read, e.g. because it does not exist. The content of a directory is its
+// listing, as read by readDir, so that adding, removing or renaming an
+// entry invalidates the evaluations which listed it.
+func hashFile(filePath string) string {
+	if isDirectory(filePath) {
+		entries, err := os.ReadDir(filePath)
+		if err != nil {
+			return ""
+		}
+
+		h := sha256.New()
+		h.Write([]byte("directory\x00"))
+		for _, entry := range entries {
+			fmt.Fprintf(h, "%s\x00%s\x00", entry.Name(), entry.Type())
+		}
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashInputs returns the content hashes of the files, and directory
+// listings, read during the traced evaluation. The paths it failed to
+// find hash to "", so that creating one of them invalidates the entry.
+// Store paths are immutable, so they are left out.
+func hashInputs(outputs TraceOuts) map[string]string {
+	inputs := make(map[string]string)
+	for _, output := range outputs {
+		for _, paths := range [][]string{output.Inputs, output.Missing} {
+			for _, filePath := range paths {
+				if _, seen := inputs[filePath]; seen || storePathRegex.MatchString(filePath) {
+					continue
+				}
+				inputs[filePath] = hashFile(filePath)
+			}
+		}
+	}
+
+	return inputs
+}
+
+// loadTraceCache returns the cached evaluation, if any, provided none of
+// the files it read has changed since.
+func loadTraceCache(cacheDir string, key string) (*traceCacheEntry, bool) {
+	byteValue, err := os.ReadFile(filepath.Join(cacheDir, key+".json"))
+	if err != nil {
+		return nil, false
+	}
+
+	var entry traceCacheEntry
+	if err := json.Unmarshal(byteValue, &entry); err != nil {
+		return nil, false
+	}
+
+	for filePath, hash := range entry.Inputs {
+		if hashFile(filePath) != hash {
+			return nil, false
+		}
+	}
+
+	return &entry, true
+}
+
+// storeTraceCache caches the evaluation. The entry is written to a
+// temporary file first, so that concurrent runs never read partial
+// entries.
+func storeTraceCache(cacheDir string, key string, trace TraceOuts, ifd []string) error {
+	byteValue, err := json.Marshal(&traceCacheEntry{
+		Inputs: hashInputs(trace),
+		Trace:  trace,
+		IFD:    ifd,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return err
+	}
+	tmpfile, err := os.CreateTemp(cacheDir, key+"*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write(byteValue); err != nil {
+		tmpfile.Close()
+		return err
+	}
+	if err := tmpfile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpfile.Name(), filepath.Join(cacheDir, key+".json"))
+}
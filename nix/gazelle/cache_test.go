@@ -0,0 +1,105 @@
+package gazelle
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTraceCacheInvalidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, workspaceRoot string)
+		valid  bool
+	}{
+		{
+			name:   "unchanged",
+			change: func(t *testing.T, workspaceRoot string) {},
+			valid:  true,
+		},
+		{
+			name: "file modified",
+			change: func(t *testing.T, workspaceRoot string) {
+				writeFile(t, filepath.Join(workspaceRoot, "pkg/default.nix"), "{ }: 2")
+			},
+		},
+		{
+			name: "file removed",
+			change: func(t *testing.T, workspaceRoot string) {
+				if err := os.Remove(filepath.Join(workspaceRoot, "pkg/default.nix")); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "entry added to a listed directory",
+			change: func(t *testing.T, workspaceRoot string) {
+				writeFile(t, filepath.Join(workspaceRoot, "pkg/src/new.c"), "")
+			},
+		},
+		{
+			name: "entry renamed in a listed directory",
+			change: func(t *testing.T, workspaceRoot string) {
+				src := filepath.Join(workspaceRoot, "pkg/src")
+				if err := os.Rename(filepath.Join(src, "main.c"), filepath.Join(src, "renamed.c")); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "missing file created",
+			change: func(t *testing.T, workspaceRoot string) {
+				writeFile(t, filepath.Join(workspaceRoot, "pkg/missing.nix"), "{ }: 3")
+			},
+		},
+		{
+			name: "entry added to an unlisted directory",
+			change: func(t *testing.T, workspaceRoot string) {
+				writeFile(t, filepath.Join(workspaceRoot, "other/new.c"), "")
+			},
+			valid: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workspaceRoot := writeWorkspace(t, map[string]string{
+				"pkg/default.nix": "{ }: 1",
+				"pkg/src/main.c":  "",
+				"other/main.c":    "",
+			})
+			cacheDir := t.TempDir()
+
+			trace := TraceOuts{
+				{
+					Cmd: TraceCmd{ID: 1, Path: "/bin/nix-instantiate"},
+					Inputs: []string{
+						filepath.Join(workspaceRoot, "pkg/default.nix"),
+						filepath.Join(workspaceRoot, "pkg/src"),
+						"/nix/store/00000000000000000000000000000000-source/default.nix",
+					},
+					Missing: []string{filepath.Join(workspaceRoot, "pkg/missing.nix")},
+				},
+			}
+			if err := storeTraceCache(cacheDir, "key", trace, []string{"/nix/store/00000000000000000000000000000000-ifd.drv"}); err != nil {
+				t.Fatal(err)
+			}
+
+			tt.change(t, workspaceRoot)
+
+			entry, valid := loadTraceCache(cacheDir, "key")
+			if valid != tt.valid {
+				t.Fatalf("loadTraceCache() valid = %t, want %t", valid, tt.valid)
+			}
+			if valid && !equalStrings(entry.IFD, []string{"/nix/store/00000000000000000000000000000000-ifd.drv"}) {
+				t.Errorf("loadTraceCache() IFD = %v", entry.IFD)
+			}
+		})
+	}
+}
+
+func TestTraceCacheMissingEntry(t *testing.T) {
+	if _, valid := loadTraceCache(t.TempDir(), "key"); valid {
+		t.Error("loadTraceCache() valid = true for a missing entry")
+	}
+}
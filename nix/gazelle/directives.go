@@ -0,0 +1,153 @@
+package gazelle
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+// directiveRegex matches a directive comment of a BUILD file, the way
+// gazelle does, capturing its key and its value.
+var directiveRegex = regexp.MustCompile(`^#\s*gazelle:(\w+)\s*(.*?)\s*$`)
+
+// directiveError is an invalid directive, located in its BUILD file.
+type directiveError struct {
+	file string
+	line int
+	key  string
+	err  error
+}
+
+func (e *directiveError) Error() string {
+	location := e.file
+	if e.line > 0 {
+		location = fmt.Sprintf("%s:%d", e.file, e.line)
+	}
+
+	return fmt.Sprintf("%s: %s: %v", location, e.key, e.err)
+}
+
+func (e *directiveError) Unwrap() error {
+	return e.err
+}
+
+// newDirectiveError locates the directive at the given index of the
+// directives of the BUILD file. Repeated directives, with the same key
+// and value, are told apart by their order. The line is 0 when the BUILD
+// file cannot be read.
+func newDirectiveError(buildFile *rule.File, index int, err error) error {
+	directive := buildFile.Directives[index]
+	content, readErr := os.ReadFile(buildFile.Path)
+	if readErr != nil {
+		return &directiveError{file: buildFile.Path, key: directive.Key, err: err}
+	}
+
+	occurrence := 0
+	for _, previous := range buildFile.Directives[:index] {
+		if previous == directive {
+			occurrence++
+		}
+	}
+
+	return &directiveError{
+		file: buildFile.Path,
+		line: directiveLine(content, directive, occurrence),
+		key:  directive.Key,
+		err:  err,
+	}
+}
+
+// directiveLine returns the line of the given occurrence, counted from 0,
+// of the directive in the BUILD file content, or 0 when it is not found.
+func directiveLine(content []byte, directive rule.Directive, occurrence int) int {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for i := 1; scanner.Scan(); i++ {
+		match := directiveRegex.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if match == nil || match[1] != directive.Key || match[2] != directive.Value {
+			continue
+		}
+		if occurrence == 0 {
+			return i
+		}
+		occurrence--
+	}
+
+	return 0
+}
+
+// directiveToken is a whitespace separated token of a directive value,
+// split into its "=" separated fields. Quoted parts of a token may
+// contain whitespace and "=".
+type directiveToken struct {
+	text   string
+	fields []string
+}
+
+// tokenizeDirective splits a directive value into tokens, honouring
+// single and double quotes, and backslash escapes within double quotes.
+func tokenizeDirective(value string) ([]directiveToken, error) {
+	var tokens []directiveToken
+	var token *directiveToken
+	var field strings.Builder
+	var text strings.Builder
+
+	endField := func() {
+		token.fields = append(token.fields, field.String())
+		field.Reset()
+	}
+	endToken := func() {
+		if token != nil {
+			endField()
+			token.text = text.String()
+			tokens = append(tokens, *token)
+			token = nil
+			text.Reset()
+		}
+	}
+
+	runes := []rune(value)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if r == ' ' || r == '\t' {
+			endToken()
+			continue
+		}
+		if token == nil {
+			token = &directiveToken{}
+		}
+		text.WriteRune(r)
+
+		switch r {
+		case '=':
+			endField()
+		case '"', '\'':
+			quote := r
+			closed := false
+			for i++; i < len(runes); i++ {
+				text.WriteRune(runes[i])
+				if runes[i] == quote {
+					closed = true
+					break
+				}
+				if quote == '"' && runes[i] == '\\' && i+1 < len(runes) {
+					i++
+					text.WriteRune(runes[i])
+				}
+				field.WriteRune(runes[i])
+			}
+			if !closed {
+				return nil, fmt.Errorf("%w: unterminated quote in %q", errParse, text.String())
+			}
+		default:
+			field.WriteRune(r)
+		}
+	}
+	endToken()
+
+	return tokens, nil
+}
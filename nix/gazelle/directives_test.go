@@ -0,0 +1,142 @@
+package gazelle
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+func TestTokenizeDirective(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  []directiveToken
+		err   bool
+	}{
+		{
+			name:  "empty",
+			value: "",
+		},
+		{
+			name:  "fields",
+			value: "nixpkgs=@nixpkgs//:nixpkgs=nix/nixpkgs.nix",
+			want: []directiveToken{
+				{text: "nixpkgs=@nixpkgs//:nixpkgs=nix/nixpkgs.nix", fields: []string{"nixpkgs", "@nixpkgs//:nixpkgs", "nix/nixpkgs.nix"}},
+			},
+		},
+		{
+			name:  "repeated spaces and tabs",
+			value: "  a=b \t  c=d  ",
+			want: []directiveToken{
+				{text: "a=b", fields: []string{"a", "b"}},
+				{text: "c=d", fields: []string{"c", "d"}},
+			},
+		},
+		{
+			name:  "quoted =",
+			value: `a="x=y"=z`,
+			want: []directiveToken{
+				{text: `a="x=y"=z`, fields: []string{"a", "x=y", "z"}},
+			},
+		},
+		{
+			name:  "quoted whitespace",
+			value: `a='my dir/file.nix' b`,
+			want: []directiveToken{
+				{text: `a='my dir/file.nix'`, fields: []string{"a", "my dir/file.nix"}},
+				{text: "b", fields: []string{"b"}},
+			},
+		},
+		{
+			name:  "escapes within double quotes",
+			value: `"a\"b" 'c\d'`,
+			want: []directiveToken{
+				{text: `"a\"b"`, fields: []string{`a"b`}},
+				{text: `'c\d'`, fields: []string{`c\d`}},
+			},
+		},
+		{
+			name:  "empty fields",
+			value: "a= =b",
+			want: []directiveToken{
+				{text: "a=", fields: []string{"a", ""}},
+				{text: "=b", fields: []string{"", "b"}},
+			},
+		},
+		{
+			name:  "unterminated double quote",
+			value: `a="b c`,
+			err:   true,
+		},
+		{
+			name:  "unterminated single quote",
+			value: `a='b`,
+			err:   true,
+		},
+		{
+			name:  "escaped closing quote",
+			value: `a="b\"`,
+			err:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tokenizeDirective(tt.value)
+			if tt.err {
+				if !errors.Is(err, errParse) {
+					t.Fatalf("tokenizeDirective(%q) error = %v, want a parse error", tt.value, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("tokenizeDirective(%q) error = %v", tt.value, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tokenizeDirective(%q) = %+v, want %+v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewDirectiveErrorLine(t *testing.T) {
+	workspaceRoot := writeWorkspace(t, map[string]string{
+		"BUILD.bazel": `# gazelle:nix_timeout 10s
+# gazelle:nix_keep_going true
+
+#   gazelle:nix_timeout   10s
+# gazelle:nix_timeout 20s
+`,
+	})
+	buildFile, err := rule.LoadFile(filepath.Join(workspaceRoot, "BUILD.bazel"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		index int
+		want  int
+	}{
+		{index: 0, want: 1},
+		{index: 1, want: 2},
+		{index: 2, want: 4},
+		{index: 3, want: 5},
+	}
+
+	for _, tt := range tests {
+		err := newDirectiveError(buildFile, tt.index, errParse)
+		var directiveErr *directiveError
+		if !errors.As(err, &directiveErr) {
+			t.Fatalf("newDirectiveError(%d) = %v, want a directive error", tt.index, err)
+		}
+		if directiveErr.line != tt.want {
+			t.Errorf("newDirectiveError(%d) line = %d, want %d", tt.index, directiveErr.line, tt.want)
+		}
+		if !errors.Is(err, errParse) {
+			t.Errorf("newDirectiveError(%d) does not wrap the parse error", tt.index)
+		}
+	}
+}
@@ -0,0 +1,595 @@
+package gazelle
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bazelbuild/bazel-gazelle/pathtools"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+	"github.com/rs/zerolog"
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+// DISCOVERY_MAX_DEPTH bounds how deep attribute sets are walked, when
+// discovering derivations.
+const DISCOVERY_MAX_DEPTH = 16
+
+// discoveryExpr walks attribute sets of an expression, and lists the
+// derivations defined in the workspace, along with the position of their
+// definitions. The position is taken from meta.position, or else from
+// the position of the attribute in its parent set. Following the nixpkgs
+// convention, the walk only recurses into the entries it starts from,
+// and into the sets marked with recurseForDerivations = true.
+//
+// When expand is true, it lists the entries below the ones it is given
+// instead, without walking them, so that a walk failing on an error
+// tryEval does not catch can be retried one attribute at a time.
+//
+// It is formatted with the expression to walk, the entries to start
+// from, the workspace root, the maximal depth, and expand.
+const discoveryExpr = `
+{ ... }@args:
+let
+  inherit (builtins) attrNames concatMap foldl' isAttrs stringLength substring tryEval unsafeGetAttrPos;
+
+  top = %s;
+  entries = builtins.fromJSON %s;
+  workspace = %s + "/";
+  maxDepth = %d;
+  expand = %t;
+
+  getPath = path: set: foldl' (s: n: s.${n}) set path;
+  inWorkspace = pos: substring 0 (stringLength workspace) pos == workspace;
+  isDerivation = v: isAttrs v && (v.type or null) == "derivation";
+  descend = force: v: force || (tryEval (v.recurseForDerivations or false)).value == true;
+
+  position = parent: name: drv:
+    let
+      meta = tryEval (drv.meta.position or null);
+      attr = unsafeGetAttrPos name parent;
+    in
+      if meta.success && meta.value != null then meta.value
+      else if attr != null then "${attr.file}:${toString attr.line}"
+      else null;
+
+  visit = depth: force: path: parent: name: value:
+    if !value.success then [ ]
+    else if isDerivation value.value then
+      let pos = position parent name value.value; in
+      if pos != null && inWorkspace pos then [ { attrPath = path; position = pos; } ] else [ ]
+    else if isAttrs value.value && depth < maxDepth && descend force value.value then
+      concatMap (n: visit (depth + 1) false (path ++ [ n ]) value.value n (tryEval value.value.${n})) (attrNames value.value)
+    else [ ];
+
+  lookup = e:
+    if e.path == [ ] then { parent = { }; name = ""; value = { success = true; value = top; }; }
+    else
+      let parent = getPath (init e.path) top; name = last e.path; in
+      { inherit parent name; value = tryEval parent.${name}; };
+
+  walkEntry = e:
+    let l = lookup e; in visit e.depth e.force e.path l.parent l.name l.value;
+
+  expandEntry = e:
+    let value = (lookup e).value; in
+    if value.success && !isDerivation value.value && isAttrs value.value
+      && e.depth < maxDepth && descend e.force value.value
+    then map (n: { path = e.path ++ [ n ]; force = false; depth = e.depth + 1; }) (attrNames value.value)
+    else [ ];
+
+  init = list: builtins.genList (builtins.elemAt list) (builtins.length list - 1);
+  last = list: builtins.elemAt list (builtins.length list - 1);
+in
+  concatMap (if expand then expandEntry else walkEntry) entries
+`
+
+// preludeExpr imports the prelude, and calls it with the arguments it
+// accepts, when it is a function.
+const preludeExpr = `
+let
+  prelude = import %s;
+  called = if builtins.isFunction prelude
+    then prelude (builtins.intersectAttrs (builtins.functionArgs prelude) args)
+    else prelude;
+in
+  builtins.foldl' (s: n: s.${n}) called %s
+`
+
+// identifierRegex matches attribute names which do not need quoting.
+var identifierRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_'-]*$`)
+
+// discoveryEntry is an attribute path the walk of discoveryExpr starts
+// from, at the given depth. The walk recurses into forced entries even
+// when they are not marked with recurseForDerivations.
+type discoveryEntry struct {
+	Path  []string `json:"path"`
+	Force bool     `json:"force"`
+	Depth int      `json:"depth"`
+}
+
+// discoveryEntries returns the forced entries of the subtrees to walk,
+// given as dot separated attribute paths.
+func discoveryEntries(roots []string) []discoveryEntry {
+	entries := make([]discoveryEntry, 0, len(roots))
+	for _, root := range roots {
+		entry := discoveryEntry{Path: []string{}, Force: true}
+		if root != "" {
+			entry.Path = strings.Split(root, ".")
+			entry.Depth = 1
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// discoveredDerivation is a derivation found while walking an
+// expression, and the file defining it.
+type discoveredDerivation struct {
+	AttrPath []string
+	Position string
+}
+
+// file returns the path of the file defining the derivation.
+func (d discoveredDerivation) file() string {
+	if i := strings.LastIndex(d.Position, ":"); i > 0 {
+		return d.Position[:i]
+	}
+
+	return d.Position
+}
+
+var (
+	discoveries      = make(map[string][]discoveredDerivation)
+	discoveriesMutex sync.Mutex
+)
+
+// nixString quotes s as a nix string literal.
+func nixString(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "${", `\${`)
+	return `"` + replacer.Replace(s) + `"`
+}
+
+// nixAttrPathList returns the nix list of attribute names of a dot
+// separated attribute path.
+func nixAttrPathList(attrPath string) string {
+	var names []string
+	if attrPath != "" {
+		for _, name := range strings.Split(attrPath, ".") {
+			names = append(names, nixString(name))
+		}
+	}
+
+	return "[ " + strings.Join(names, " ") + " ]"
+}
+
+// formatAttrPath joins attribute names, quoting those which are not
+// plain identifiers.
+func formatAttrPath(names []string) string {
+	quoted := make([]string, 0, len(names))
+	for _, name := range names {
+		if !identifierRegex.MatchString(name) {
+			name = nixString(name)
+		}
+		quoted = append(quoted, name)
+	}
+
+	return strings.Join(quoted, ".")
+}
+
+// discoverDerivations evaluates the expression once, and returns the
+// derivations found in the given subtrees. Results are cached by key for
+// the duration of the run.
+func discoverDerivations(
+	logger *zerolog.Logger,
+	nixCfg *nixconfig.NixLanguageConfig,
+	workspaceRoot string,
+	key string,
+	topExpr string,
+	roots []string,
+) (_ []discoveredDerivation, err error) {
+	discoveriesMutex.Lock()
+	defer discoveriesMutex.Unlock()
+
+	if derivations, ok := discoveries[key]; ok {
+		return derivations, nil
+	}
+
+	le := &LogEvent{
+		Path: key,
+	}
+
+	defer err2.Handle(&err, func() {
+		le.Error = err
+		le.Send(logger)
+	})
+
+	d := &discovery{
+		logger:        logger,
+		nixCfg:        nixCfg,
+		workspaceRoot: workspaceRoot,
+		topExpr:       topExpr,
+		le:            le,
+	}
+	derivations := try.To1(d.walk(discoveryEntries(roots)))
+
+	logger.Debug().
+		Str("expression", key).
+		Int("derivations", len(derivations)).
+		Msg("discovered derivations")
+	discoveries[key] = derivations
+
+	return derivations, nil
+}
+
+// discovery walks an expression with discoveryExpr.
+type discovery struct {
+	logger        *zerolog.Logger
+	nixCfg        *nixconfig.NixLanguageConfig
+	workspaceRoot string
+	topExpr       string
+	le            *LogEvent
+}
+
+// walk returns the derivations found below the entries, in a single
+// evaluation when possible. When it fails, e.g. on an error tryEval does
+// not catch, the entries are walked one by one, and a failing entry is
+// replaced with the entries below it, so that a broken attribute only
+// drops itself. Only the failure of a forced entry is an error.
+func (d *discovery) walk(entries []discoveryEntry) ([]discoveredDerivation, error) {
+	var derivations []discoveredDerivation
+	err := d.eval(entries, false, &derivations)
+	if err == nil || errors.Is(err, errTimeout) {
+		return derivations, err
+	}
+
+	if len(entries) > 1 {
+		derivations = nil
+		for _, entry := range entries {
+			found, err := d.walk([]discoveryEntry{entry})
+			if err != nil {
+				return nil, err
+			}
+			derivations = append(derivations, found...)
+		}
+		return derivations, nil
+	}
+
+	var children []discoveryEntry
+	if expandErr := d.eval(entries, true, &children); expandErr != nil || len(children) == 0 {
+		if entries[0].Force {
+			return nil, err
+		}
+		d.logger.Warn().
+			Str("attribute", formatAttrPath(entries[0].Path)).
+			Msg("skipping an attribute which fails to evaluate")
+		return nil, nil
+	}
+
+	return d.walk(children)
+}
+
+// eval evaluates discoveryExpr with the entries, and decodes its result.
+func (d *discovery) eval(entries []discoveryEntry, expand bool, result interface{}) (err error) {
+	defer err2.Return(&err)
+
+	entriesJSON := try.To1(json.Marshal(entries))
+	expr := fmt.Sprintf(
+		discoveryExpr,
+		d.topExpr,
+		nixString(string(entriesJSON)),
+		nixString(d.workspaceRoot),
+		DISCOVERY_MAX_DEPTH,
+		expand,
+	)
+
+	env := try.To1(newEvalEnvironment(d.nixCfg))
+	defer env.Close()
+
+	ev := try.To1(newEvaluator(d.workspaceRoot, d.nixCfg))
+	command := newExprEvalCommand(d.workspaceRoot, d.nixCfg, ev, expr)
+
+	var stdout, stderr bytes.Buffer
+	cmd, runErr := command.run(env, d.nixCfg.Timeout, &stdout, &stderr)
+
+	defer err2.Handle(&err, func() {
+		d.le.Details = stderr.Bytes()
+		d.le.Command = strings.Join(cmd.Args, " ")
+		d.le.SetMessage("discovery of derivations failed")
+	})
+	try.To(runErr)
+
+	return json.Unmarshal(stdout.Bytes(), result)
+}
+
+// discoverPreludeAttributes evaluates the attribute tree of the prelude,
+// and maps the workspace relative directories defining derivations to
+// their attribute paths. When several attributes are defined in the
+// same directory, the shortest attribute path is used.
+func discoverPreludeAttributes(
+	logger *zerolog.Logger,
+	nixCfg *nixconfig.NixLanguageConfig,
+	workspaceRoot string,
+) (map[string]string, error) {
+	prelude := filepath.Join(workspaceRoot, nixCfg.NixPrelude)
+	topExpr := fmt.Sprintf(
+		preludeExpr,
+		nixString(prelude),
+		nixAttrPathList(nixCfg.NixPreludeAttrPrefix),
+	)
+	key := strings.Join(
+		append([]string{prelude, nixCfg.NixPreludeAttrPrefix}, nixCfg.AttributeDiscovery...),
+		" ",
+	)
+
+	derivations, err := discoverDerivations(
+		logger,
+		nixCfg,
+		workspaceRoot,
+		key,
+		topExpr,
+		nixCfg.AttributeDiscovery,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	attrPaths := make(map[string][]string)
+	for _, d := range derivations {
+		dir := pathtools.TrimPrefix(filepath.Dir(d.file()), workspaceRoot)
+		attrPath := d.AttrPath
+		if nixCfg.NixPreludeAttrPrefix != "" {
+			attrPath = append(strings.Split(nixCfg.NixPreludeAttrPrefix, "."), attrPath...)
+		}
+		attrPaths[dir] = append(attrPaths[dir], formatAttrPath(attrPath))
+	}
+
+	byDir := make(map[string]string, len(attrPaths))
+	for dir, candidates := range attrPaths {
+		sort.Slice(candidates, func(i, j int) bool {
+			if len(candidates[i]) != len(candidates[j]) {
+				return len(candidates[i]) < len(candidates[j])
+			}
+			return candidates[i] < candidates[j]
+		})
+		byDir[dir] = candidates[0]
+	}
+
+	return byDir, nil
+}
+
+// overlayExpr applies the overlay to the package set of a search path
+// entry. It is formatted with the path of the overlay, and the name of
+// the search path entry.
+const overlayExpr = `import <%[2]s> { overlays = [ (import %[1]s) ]; }`
+
+// overlayAttrsExpr evaluates to the attributes of the package set which
+// are defined by the overlay, as seen in the package set the overlay is
+// applied to. It is formatted like overlayExpr.
+const overlayAttrsExpr = `
+let
+  overlay = import %[1]s;
+  prev = import <%[2]s> { };
+  final = import <%[2]s> { overlays = [ overlay ]; };
+in
+  builtins.intersectAttrs (overlay final prev) final
+`
+
+// discoverConfiguredDerivations evaluates the configured overlay, or
+// attribute set, and returns the derivations it defines. Their attribute
+// paths are relative to the package set the overlay is applied to, or to
+// the attribute path of the attribute set.
+func discoverConfiguredDerivations(
+	logger *zerolog.Logger,
+	nixCfg *nixconfig.NixLanguageConfig,
+	workspaceRoot string,
+) ([]discoveredDerivation, error) {
+	discovery := nixCfg.Discovery
+	file := filepath.Join(workspaceRoot, discovery.File)
+
+	var topExpr string
+	switch discovery.Kind {
+	case nixconfig.DISCOVERY_OVERLAY:
+		topExpr = fmt.Sprintf(overlayAttrsExpr, nixString(file), discovery.Arg)
+	default:
+		topExpr = fmt.Sprintf(preludeExpr, nixString(file), nixAttrPathList(discovery.Arg))
+	}
+
+	return discoverDerivations(
+		logger,
+		nixCfg,
+		workspaceRoot,
+		strings.Join([]string{string(discovery.Kind), file, discovery.Arg}, " "),
+		topExpr,
+		[]string{""},
+	)
+}
+
+// discoveredEvalTarget returns the evaluation target of a discovered
+// derivation.
+func discoveredEvalTarget(
+	workspaceRoot string,
+	discovery *nixconfig.Discovery,
+	d discoveredDerivation,
+) evalTarget {
+	file := filepath.Join(workspaceRoot, discovery.File)
+	if discovery.Kind == nixconfig.DISCOVERY_OVERLAY {
+		return evalTarget{
+			expr:     fmt.Sprintf(overlayExpr, nixString(file), discovery.Arg),
+			attrPath: formatAttrPath(d.AttrPath),
+		}
+	}
+
+	return evalTarget{
+		file:     file,
+		attrPath: discoveredAttrPath(discovery, d),
+	}
+}
+
+// discoveredAttrPath returns the attribute path of a discovered
+// derivation, relative to the evaluated file.
+func discoveredAttrPath(discovery *nixconfig.Discovery, d discoveredDerivation) string {
+	attrPath := d.AttrPath
+	if discovery.Kind == nixconfig.DISCOVERY_ATTRSET && discovery.Arg != "" {
+		attrPath = append(strings.Split(discovery.Arg, "."), attrPath...)
+	}
+
+	return formatAttrPath(attrPath)
+}
+
+// reachabilityExpr filters the attribute paths which exist in an
+// expression. The values along the paths are evaluated, but not the
+// values they lead to.
+//
+// It is formatted with the expression, and the list of attribute paths.
+const reachabilityExpr = `
+{ ... }@args:
+let
+  inherit (builtins) filter head isAttrs tail tryEval;
+
+  top = %s;
+
+  reachable = set: path:
+    if path == [ ] then true
+    else if !(set ? ${head path}) then false
+    else if tail path == [ ] then true
+    else
+      let value = tryEval set.${head path}; in
+      value.success && isAttrs value.value && reachable value.value (tail path);
+in
+  filter (reachable top) %s
+`
+
+var (
+	reachabilities      = make(map[string]map[string]bool)
+	reachabilitiesMutex sync.Mutex
+)
+
+// preludePackages walks the directory declaring the prelude, skipping
+// ignored directories, and maps the attribute paths of the packages
+// defined by default.nix files to their workspace relative directories.
+func preludePackages(
+	nixCfg *nixconfig.NixLanguageConfig,
+	workspaceRoot string,
+) (map[string]string, error) {
+	root := filepath.Join(workspaceRoot, nixCfg.NixPreludeRoot)
+	packages := make(map[string]string)
+
+	err := filepath.WalkDir(root, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if entry.Name() == ".git" || hasIgnoreMarker(p, nixCfg.IgnoreMarkers) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.Name() != "default.nix" || filepath.Dir(p) == root {
+			return nil
+		}
+
+		rel := pathtools.TrimPrefix(filepath.Dir(p), workspaceRoot)
+		packages[nixAttributePath(nixCfg, rel)] = rel
+		return nil
+	})
+
+	return packages, err
+}
+
+// reachablePreludePackages tells, for the attribute path of every
+// package found on disk below the directory declaring the prelude,
+// whether it exists in the prelude. Packages may be unreachable when the
+// prelude does not walk into their directory, e.g. hidden directories,
+// or directories nested in another package. Results are cached for the
+// duration of the run.
+func reachablePreludePackages(
+	logger *zerolog.Logger,
+	nixCfg *nixconfig.NixLanguageConfig,
+	workspaceRoot string,
+) (_ map[string]bool, err error) {
+	reachabilitiesMutex.Lock()
+	defer reachabilitiesMutex.Unlock()
+
+	prelude := filepath.Join(workspaceRoot, nixCfg.NixPrelude)
+	key := strings.Join(
+		append([]string{prelude, nixCfg.NixPreludeAttrPrefix}, nixCfg.IgnoreMarkers...),
+		" ",
+	)
+	if reachability, ok := reachabilities[key]; ok {
+		return reachability, nil
+	}
+
+	le := &LogEvent{
+		Path: prelude,
+	}
+
+	defer err2.Handle(&err, func() {
+		le.Error = err
+		le.Send(logger)
+	})
+
+	packages := try.To1(preludePackages(nixCfg, workspaceRoot))
+	attrPaths := make([]string, 0, len(packages))
+	for attrPath := range packages {
+		attrPaths = append(attrPaths, nixAttrPathList(attrPath))
+	}
+	sort.Strings(attrPaths)
+
+	expr := fmt.Sprintf(
+		reachabilityExpr,
+		fmt.Sprintf(preludeExpr, nixString(prelude), nixAttrPathList("")),
+		"[ "+strings.Join(attrPaths, " ")+" ]",
+	)
+
+	env := try.To1(newEvalEnvironment(nixCfg))
+	defer env.Close()
+
+	ev := try.To1(newEvaluator(workspaceRoot, nixCfg))
+	command := newExprEvalCommand(workspaceRoot, nixCfg, ev, expr)
+
+	var stdout, stderr bytes.Buffer
+	cmd, runErr := command.run(env, nixCfg.Timeout, &stdout, &stderr)
+
+	defer err2.Handle(&err, func() {
+		le.Details = stderr.Bytes()
+		le.Command = strings.Join(cmd.Args, " ")
+		le.SetMessage("evaluation of the prelude packages failed")
+	})
+	try.To(runErr)
+
+	var reachable [][]string
+	try.To(json.Unmarshal(stdout.Bytes(), &reachable))
+
+	reachability := make(map[string]bool, len(packages))
+	for attrPath := range packages {
+		reachability[attrPath] = false
+	}
+	for _, attrPath := range reachable {
+		reachability[strings.Join(attrPath, ".")] = true
+	}
+
+	unreachable := 0
+	for _, ok := range reachability {
+		if !ok {
+			unreachable++
+		}
+	}
+	logger.Debug().
+		Str("prelude", nixCfg.NixPrelude).
+		Int("packages", len(packages)).
+		Int("unreachable", unreachable).
+		Msg("checked the reachability of packages")
+	reachabilities[key] = reachability
+
+	return reachability, nil
+}
@@ -0,0 +1,99 @@
+package gazelle
+
+import (
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+func TestDiscoveryEntries(t *testing.T) {
+	got := discoveryEntries([]string{"", "pkgs.tools"})
+	want := []discoveryEntry{
+		{Path: []string{}, Force: true, Depth: 0},
+		{Path: []string{"pkgs", "tools"}, Force: true, Depth: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("discoveryEntries() = %+v, want %+v", got, want)
+	}
+}
+
+// nestedPackageSet mimics nixpkgs: only the sets marked with
+// recurseForDerivations are walked, and a broken attribute, failing
+// with an error tryEval does not catch, is skipped.
+const nestedPackageSet = `{
+  hello = { type = "derivation"; name = "hello"; };
+  pkgs = {
+    recurseForDerivations = true;
+    tool = { type = "derivation"; name = "tool"; };
+    nested = {
+      recurseForDerivations = true;
+      lib = { type = "derivation"; name = "lib"; };
+    };
+    unmarked = {
+      hidden = { type = "derivation"; name = "hidden"; };
+    };
+  };
+  lib = {
+    helper = { type = "derivation"; name = "helper"; };
+  };
+  broken = abort "broken";
+}
+`
+
+func TestDiscoverNestedPackageSet(t *testing.T) {
+	if _, err := exec.LookPath("nix-instantiate"); err != nil {
+		t.Skip("nix-instantiate is not available")
+	}
+
+	workspaceRoot := writeWorkspace(t, map[string]string{
+		"default.nix": nestedPackageSet,
+	})
+	logger := zerolog.Nop()
+
+	tests := []struct {
+		name  string
+		roots []string
+		want  []string
+	}{
+		{
+			name:  "whole set",
+			roots: []string{""},
+			want:  []string{"hello", "pkgs.nested.lib", "pkgs.tool"},
+		},
+		{
+			name:  "unmarked root",
+			roots: []string{"lib", "pkgs.unmarked"},
+			want:  []string{"lib.helper", "pkgs.unmarked.hidden"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			derivations, err := discoverDerivations(
+				&logger,
+				nixconfig.New(),
+				workspaceRoot,
+				workspaceRoot+" "+tt.name,
+				"import "+nixString(workspaceRoot+"/default.nix"),
+				tt.roots,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, d := range derivations {
+				got = append(got, strings.Join(d.AttrPath, "."))
+			}
+			sort.Strings(got)
+			if !equalStrings(got, tt.want) {
+				t.Errorf("discoverDerivations() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
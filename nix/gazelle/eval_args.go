@@ -0,0 +1,79 @@
+package gazelle
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+// optionNameRegex matches the names of nix options, e.g. cores or
+// extra-substituters.
+var optionNameRegex = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+// reservedOptions are nix options set by other directives, which take
+// precedence over nix_option.
+var reservedOptions = map[string]string{
+	"restrict-eval":                nixconfig.NIX_RESTRICT_EVAL,
+	"allowed-uris":                 nixconfig.NIX_ALLOWED_URIS,
+	"allow-import-from-derivation": nixconfig.NIX_IFD_POLICY,
+}
+
+// sortedKeys returns the keys of the map, sorted, so that arguments are
+// passed in a stable order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// autoArgs returns the --arg and --argstr arguments functions are called
+// with.
+func autoArgs(nixCfg *nixconfig.NixLanguageConfig) []string {
+	var args []string
+	for _, name := range sortedKeys(nixCfg.NixArgs) {
+		args = append(args, "--arg", name, nixCfg.NixArgs[name])
+	}
+	for _, name := range sortedKeys(nixCfg.NixArgStrs) {
+		args = append(args, "--argstr", name, nixCfg.NixArgStrs[name])
+	}
+
+	return args
+}
+
+// autoArgsExpr returns the attribute set of the arguments functions are
+// called with, as a nix expression.
+func autoArgsExpr(nixCfg *nixconfig.NixLanguageConfig) string {
+	var attrs []string
+	for _, name := range sortedKeys(nixCfg.NixArgs) {
+		attrs = append(attrs, fmt.Sprintf("%s = (%s);", nixString(name), nixCfg.NixArgs[name]))
+	}
+	for _, name := range sortedKeys(nixCfg.NixArgStrs) {
+		attrs = append(attrs, fmt.Sprintf("%s = %s;", nixString(name), nixString(nixCfg.NixArgStrs[name])))
+	}
+
+	return "{ " + strings.Join(attrs, " ") + " }"
+}
+
+// optionArgs returns the --option arguments of the configured nix
+// options.
+func optionArgs(nixCfg *nixconfig.NixLanguageConfig) []string {
+	var args []string
+	for _, name := range sortedKeys(nixCfg.NixOptions) {
+		args = append(args, "--option", name, nixCfg.NixOptions[name])
+	}
+
+	return args
+}
+
+// manifestNixopts returns the nixopts of the generated manifests, so that
+// builds evaluate the expression the way it was traced.
+func manifestNixopts(nixCfg *nixconfig.NixLanguageConfig) []string {
+	return append(autoArgs(nixCfg), optionArgs(nixCfg)...)
+}
@@ -0,0 +1,221 @@
+package gazelle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+var errTimeout = errors.New("timeout exceeded")
+
+// defaultEnvAllowlist lists the variables of the user environment which
+// are passed to the evaluation. Everything else, such as NIX_CONFIG or
+// NIX_PATH, is dropped.
+var defaultEnvAllowlist = []string{
+	"LANG",
+	"LC_ALL",
+	"NIX_REMOTE",
+	"NIX_SSL_CERT_FILE",
+	"PATH",
+	"SSL_CERT_FILE",
+	"TMPDIR",
+	"TZ",
+	"USER",
+}
+
+// explicitNixOptions are passed to every evaluation, so that it does not
+// depend on how the evaluator of the user is configured.
+var explicitNixOptions = [][2]string{
+	{"pure-eval", "false"},
+	{"show-trace", "true"},
+}
+
+// evalCommand is the argument vector of a single evaluation.
+type evalCommand struct {
+	args []string
+}
+
+// evalTarget is what an evaluation instantiates: either a nix file, or
+// a nix expression, optionally narrowed down to an attribute path.
+type evalTarget struct {
+	file     string
+	expr     string
+	attrPath string
+}
+
+// packageEvalTarget returns the evaluation target of the package defined
+// by the nix file. When a prelude is configured, the package is selected
+// by its attribute path, otherwise the nix file is evaluated on its own.
+func packageEvalTarget(
+	workspaceRoot string,
+	nixCfg *nixconfig.NixLanguageConfig,
+	nixFile string,
+	nixAttrPath string,
+) evalTarget {
+	if usesPrelude(nixCfg) {
+		return evalTarget{
+			file:     filepath.Join(workspaceRoot, nixCfg.NixPrelude),
+			attrPath: nixAttrPath,
+		}
+	}
+
+	return evalTarget{file: nixFile}
+}
+
+// newEvalCommand builds the evaluator invocation of the target.
+func newEvalCommand(
+	workspaceRoot string,
+	nixCfg *nixconfig.NixLanguageConfig,
+	ev *evaluator,
+	target evalTarget,
+) *evalCommand {
+	args := ev.instantiateArgs(target)
+
+	return &evalCommand{args: append(args, commonEvalArgs(workspaceRoot, nixCfg)...)}
+}
+
+// newExprEvalCommand builds the evaluator invocation evaluating the
+// expression strictly, and printing the result as JSON.
+func newExprEvalCommand(
+	workspaceRoot string,
+	nixCfg *nixconfig.NixLanguageConfig,
+	ev *evaluator,
+	expr string,
+) *evalCommand {
+	args := ev.evalJSONArgs(expr, autoArgsExpr(nixCfg))
+
+	return &evalCommand{args: append(args, commonEvalArgs(workspaceRoot, nixCfg)...)}
+}
+
+// commonEvalArgs returns the arguments shared by every evaluation: the
+// search path, the arguments of functions, and the nix options. Options
+// set by directives override the explicit ones, but not those required
+// by restricted evaluation, or by the import-from-derivation policy.
+func commonEvalArgs(workspaceRoot string, nixCfg *nixconfig.NixLanguageConfig) []string {
+	var args []string
+	for _, entry := range searchPathEntries(workspaceRoot, nixCfg.NixSearchPath) {
+		args = append(args, "-I", entry)
+	}
+	args = append(args, autoArgs(nixCfg)...)
+	for _, option := range explicitNixOptions {
+		args = append(args, "--option", option[0], option[1])
+	}
+	args = append(args, optionArgs(nixCfg)...)
+	args = append(args, restrictedEvalArgs(workspaceRoot, nixCfg)...)
+	args = append(args, ifdArgs(nixCfg.IFDPolicy)...)
+
+	return args
+}
+
+// traced wraps the command with the tracer, writing its report to
+// traceFile.
+func (c *evalCommand) traced(t tracer, traceFile string) {
+	c.args = t.wrap(c.args, traceFile)
+}
+
+// run runs the command in the environment, within the timeout when it is
+// positive, and once an evaluation slot is available.
+func (c *evalCommand) run(
+	env *evalEnvironment,
+	timeout time.Duration,
+	stdout io.Writer,
+	stderr io.Writer,
+) (*exec.Cmd, error) {
+	// The timeout only starts once the evaluation does, so that waiting
+	// for a slot does not count.
+	release := acquireEvalSlot()
+	defer release()
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, c.args[0], c.args[1:]...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env = env.env
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return cmd, fmt.Errorf("%w: evaluation timed out after %s", errTimeout, timeout)
+	}
+
+	return cmd, err
+}
+
+// evalEnvironment is an isolated environment for evaluations, with a
+// scratch home directory, so that nothing from the user configuration
+// leaks into the results.
+type evalEnvironment struct {
+	scratch string
+	env     []string
+}
+
+func newEvalEnvironment(nixCfg *nixconfig.NixLanguageConfig) (*evalEnvironment, error) {
+	scratch, err := ioutil.TempDir("", "nix-gzl-home*")
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := make(map[string]bool)
+	for _, name := range append(defaultEnvAllowlist, nixCfg.EnvAllow...) {
+		allowed[name] = true
+	}
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if allowed[strings.SplitN(kv, "=", 2)[0]] {
+			env = append(env, kv)
+		}
+	}
+
+	for name, dir := range map[string]string{
+		"HOME":            "home",
+		"XDG_CACHE_HOME":  "cache",
+		"XDG_CONFIG_HOME": "config",
+		"XDG_DATA_HOME":   "data",
+		"XDG_STATE_HOME":  "state",
+	} {
+		path := filepath.Join(scratch, dir)
+		if err := os.Mkdir(path, 0o700); err != nil {
+			os.RemoveAll(scratch)
+			return nil, err
+		}
+		env = append(env, name+"="+path)
+	}
+	env = append(env, "NIX_PATH=")
+	sort.Strings(env)
+
+	return &evalEnvironment{scratch: scratch, env: env}, nil
+}
+
+// stableEnv returns the variables of the environment which do not
+// depend on its scratch directories.
+func (e *evalEnvironment) stableEnv() []string {
+	var env []string
+	for _, kv := range e.env {
+		if !strings.Contains(kv, e.scratch) {
+			env = append(env, kv)
+		}
+	}
+
+	return env
+}
+
+// Close removes the scratch directories.
+func (e *evalEnvironment) Close() error {
+	return os.RemoveAll(e.scratch)
+}
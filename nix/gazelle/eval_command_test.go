@@ -0,0 +1,85 @@
+package gazelle
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+func TestEvalTimeoutExcludesSlotWait(t *testing.T) {
+	defer setJobs(len(evalSlots))
+	setJobs(1)
+
+	release := acquireEvalSlot()
+	done := make(chan error)
+	go func() {
+		command := &evalCommand{args: []string{"true"}}
+		_, err := command.run(&evalEnvironment{}, 100*time.Millisecond, io.Discard, io.Discard)
+		done <- err
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	release()
+	if err := <-done; err != nil {
+		t.Errorf("run() = %v, want no error once a slot is free", err)
+	}
+}
+
+func TestNewEvalEnvironment(t *testing.T) {
+	t.Setenv("PATH", "/usr/bin")
+	t.Setenv("NIX_CONFIG", "experimental-features = flakes")
+	t.Setenv("NIX_PATH", "nixpkgs=/etc/nixpkgs")
+	t.Setenv("HOME", "/home/user")
+	t.Setenv("GITHUB_TOKEN", "secret")
+	t.Setenv("CUSTOM", "value")
+
+	nixCfg := nixconfig.New()
+	nixCfg.EnvAllow = []string{"CUSTOM"}
+	env, err := newEvalEnvironment(nixCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+
+	vars := make(map[string]string)
+	for _, kv := range env.env {
+		parts := strings.SplitN(kv, "=", 2)
+		vars[parts[0]] = parts[1]
+	}
+
+	for name, want := range map[string]string{"PATH": "/usr/bin", "CUSTOM": "value", "NIX_PATH": ""} {
+		if got, ok := vars[name]; !ok || got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	for _, name := range []string{"NIX_CONFIG", "GITHUB_TOKEN"} {
+		if _, ok := vars[name]; ok {
+			t.Errorf("%s is passed to the evaluation", name)
+		}
+	}
+	for _, name := range []string{"HOME", "XDG_CACHE_HOME", "XDG_CONFIG_HOME", "XDG_DATA_HOME", "XDG_STATE_HOME"} {
+		if dir := vars[name]; filepath.Dir(dir) != env.scratch {
+			t.Errorf("%s = %q, want a directory of %q", name, dir, env.scratch)
+		} else if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			t.Errorf("%s = %q is not a directory", name, dir)
+		}
+	}
+
+	for _, kv := range env.stableEnv() {
+		if strings.Contains(kv, env.scratch) {
+			t.Errorf("stableEnv() contains %q", kv)
+		}
+	}
+
+	if err := env.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(env.scratch); !os.IsNotExist(err) {
+		t.Errorf("scratch directory %q is left after Close()", env.scratch)
+	}
+}
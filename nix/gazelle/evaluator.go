@@ -0,0 +1,172 @@
+package gazelle
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/bazelbuild/rules_go/go/tools/bazel"
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+var errEvaluator = errors.New("cannot use the evaluator")
+
+// versionRegex matches the output of `<evaluator> --version`, capturing
+// the implementation and its version, e.g. "nix-instantiate (Nix) 2.18.1"
+// or "nix (Lix, like Nix) 2.91.0".
+var versionRegex = regexp.MustCompile(`^\S+ \((\w+)[^)]*\) (\S+)`)
+
+// evaluator is a resolved evaluator binary, along with the command line
+// interface it is invoked through, and the nix implementation behind it.
+type evaluator struct {
+	binary string
+	cli    nixconfig.EvaluatorCLI
+	// implementation is "Nix" or "Lix", and version its version, as
+	// reported by the evaluator.
+	implementation string
+	version        string
+}
+
+var (
+	evaluators      = make(map[string]*evaluator)
+	evaluatorsMutex sync.Mutex
+)
+
+// newEvaluator resolves the configured evaluator, and detects its command
+// line interface, unless configured, and its implementation. Evaluators
+// are resolved once per run.
+func newEvaluator(workspaceRoot string, nixCfg *nixconfig.NixLanguageConfig) (*evaluator, error) {
+	evaluatorsMutex.Lock()
+	defer evaluatorsMutex.Unlock()
+
+	key := nixCfg.Evaluator + " " + string(nixCfg.EvaluatorCLI)
+	if e, ok := evaluators[key]; ok {
+		return e, nil
+	}
+
+	binary, err := resolveEvaluatorBinary(workspaceRoot, nixCfg.Evaluator)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %v", errEvaluator, nixCfg.Evaluator, err)
+	}
+
+	cli := nixCfg.EvaluatorCLI
+	if cli == nixconfig.CLI_AUTO {
+		cli = nixconfig.CLI_LEGACY
+		if filepath.Base(binary) == "nix" {
+			cli = nixconfig.CLI_NIX
+		}
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(binary, "--version")
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%w %q: %v", errEvaluator, binary, err)
+	}
+	match := versionRegex.FindStringSubmatch(stdout.String())
+	if match == nil {
+		return nil, fmt.Errorf("%w %q: unknown version %q", errEvaluator, binary, stdout.String())
+	}
+
+	e := &evaluator{
+		binary:         binary,
+		cli:            cli,
+		implementation: match[1],
+		version:        match[2],
+	}
+	evaluators[key] = e
+
+	return e, nil
+}
+
+// resolveEvaluatorBinary returns the path of the evaluator binary, given
+// as a label, e.g. the binary of a nixpkgs toolchain available in the
+// runfiles, as an absolute path, or as a name looked up in PATH.
+func resolveEvaluatorBinary(workspaceRoot string, evaluator string) (string, error) {
+	if strings.HasPrefix(evaluator, "@") || strings.HasPrefix(evaluator, "//") {
+		binaryLabel, err := label.Parse(evaluator)
+		if err != nil {
+			return "", err
+		}
+		if binaryLabel.Repo == "" {
+			return filepath.Join(workspaceRoot, binaryLabel.Pkg, binaryLabel.Name), nil
+		}
+
+		return bazel.Runfile(path.Join("external", binaryLabel.Repo, binaryLabel.Pkg, binaryLabel.Name))
+	}
+
+	if filepath.IsAbs(evaluator) {
+		return evaluator, nil
+	}
+
+	return exec.LookPath(evaluator)
+}
+
+// String describes the evaluator, e.g. for cache keys and logs.
+func (e *evaluator) String() string {
+	return fmt.Sprintf("%s (%s %s, %s)", e.binary, e.implementation, e.version, e.cli)
+}
+
+// instantiateArgs returns the arguments instantiating the target, so that
+// the derivation and everything it depends on are evaluated.
+func (e *evaluator) instantiateArgs(target evalTarget) []string {
+	if e.cli == nixconfig.CLI_NIX {
+		// Forcing drvPath instantiates the derivation, as nix-instantiate
+		// does
+		attrPath := "drvPath"
+		if target.attrPath != "" {
+			attrPath = target.attrPath + ".drvPath"
+		}
+
+		args := append(e.newCLIArgs("eval"), "--raw")
+		if target.expr != "" {
+			return append(args, "--expr", target.expr, attrPath)
+		}
+		return append(args, "--file", target.file, attrPath)
+	}
+
+	args := []string{e.binary}
+	if target.expr != "" {
+		args = append(args, "-E", target.expr)
+	} else {
+		args = append(args, target.file)
+	}
+	if target.attrPath != "" {
+		args = append(args, "-A", target.attrPath)
+	}
+
+	return args
+}
+
+// evalJSONArgs returns the arguments evaluating the expression strictly,
+// and printing the result as JSON. When the expression is a function, it
+// is called with the argsExpr attribute set.
+func (e *evaluator) evalJSONArgs(expr string, argsExpr string) []string {
+	if e.cli == nixconfig.CLI_NIX {
+		// Unlike nix-instantiate, nix eval does not call functions
+		// without an attribute path
+		called := fmt.Sprintf("let f = %s; in if builtins.isFunction f then f %s else f", expr, argsExpr)
+		return append(e.newCLIArgs("eval"), "--json", "--expr", called)
+	}
+
+	return []string{e.binary, "--eval", "--strict", "--json", "-E", expr}
+}
+
+// newCLIArgs returns the arguments running a subcommand of the new
+// command line interface. It is experimental in both Nix and Lix, and
+// its progress bar is replaced with the plain logs the legacy commands
+// print, which are parsed for realisations.
+func (e *evaluator) newCLIArgs(subcommand string) []string {
+	return []string{
+		e.binary, subcommand,
+		"--extra-experimental-features", "nix-command",
+		"--log-format", "raw",
+	}
+}
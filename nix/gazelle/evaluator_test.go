@@ -0,0 +1,65 @@
+package gazelle
+
+import (
+	"testing"
+
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+func TestInstantiateArgs(t *testing.T) {
+	legacy := &evaluator{binary: "/bin/nix-instantiate", cli: nixconfig.CLI_LEGACY}
+	nix := &evaluator{binary: "/bin/nix", cli: nixconfig.CLI_NIX}
+	newCLI := []string{"/bin/nix", "eval", "--extra-experimental-features", "nix-command", "--log-format", "raw", "--raw"}
+
+	tests := []struct {
+		name   string
+		ev     *evaluator
+		target evalTarget
+		want   []string
+	}{
+		{
+			name:   "legacy file",
+			ev:     legacy,
+			target: evalTarget{file: "/ws/pkg/default.nix"},
+			want:   []string{"/bin/nix-instantiate", "/ws/pkg/default.nix"},
+		},
+		{
+			name:   "legacy attribute",
+			ev:     legacy,
+			target: evalTarget{file: "/ws/default.nix", attrPath: "folks.cowsay"},
+			want:   []string{"/bin/nix-instantiate", "/ws/default.nix", "-A", "folks.cowsay"},
+		},
+		{
+			name:   "legacy expression",
+			ev:     legacy,
+			target: evalTarget{expr: "import <nixpkgs> { }", attrPath: "hello"},
+			want:   []string{"/bin/nix-instantiate", "-E", "import <nixpkgs> { }", "-A", "hello"},
+		},
+		{
+			name:   "nix file",
+			ev:     nix,
+			target: evalTarget{file: "/ws/pkg/default.nix"},
+			want:   append(newCLI[:len(newCLI):len(newCLI)], "--file", "/ws/pkg/default.nix", "drvPath"),
+		},
+		{
+			name:   "nix attribute",
+			ev:     nix,
+			target: evalTarget{file: "/ws/default.nix", attrPath: "folks.cowsay"},
+			want:   append(newCLI[:len(newCLI):len(newCLI)], "--file", "/ws/default.nix", "folks.cowsay.drvPath"),
+		},
+		{
+			name:   "nix expression",
+			ev:     nix,
+			target: evalTarget{expr: "import <nixpkgs> { }", attrPath: "hello"},
+			want:   append(newCLI[:len(newCLI):len(newCLI)], "--expr", "import <nixpkgs> { }", "hello.drvPath"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ev.instantiateArgs(tt.target); !equalStrings(got, tt.want) {
+				t.Errorf("instantiateArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
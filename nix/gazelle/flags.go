@@ -0,0 +1,121 @@
+package gazelle
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/private/logconfig"
+)
+
+const (
+	FLAG_TRACER      = "nix_tracer"
+	FLAG_TRACER_PATH = "nix_tracer_path"
+	FLAG_EVALUATOR   = "nix_evaluator"
+	FLAG_CLI         = "nix_evaluator_cli"
+	FLAG_JOBS        = "nix_jobs"
+	FLAG_TIMEOUT     = "nix_timeout"
+	FLAG_CACHE_DIR   = "nix_cache_dir"
+	FLAG_KEEP_GOING  = "nix_keep_going"
+	FLAG_LOG_FORMAT  = "nix_log_format"
+	FLAG_IFD_PROBE   = "nix_ifd_probe"
+)
+
+var errFlag = errors.New("invalid flag value")
+
+// nixFlags holds the raw values of the command-line flags, until they
+// are validated by CheckFlags.
+type nixFlags struct {
+	tracer     string
+	tracerPath string
+	evaluator  string
+	cli        string
+	jobs       int
+	timeout    time.Duration
+	cacheDir   string
+	keepGoing  bool
+	logFormat  string
+	ifdProbe   bool
+}
+
+// register binds the flags to the flag set, defaulting to the values of
+// the root configuration, and to the current format of the logs.
+func (f *nixFlags) register(flagSet *flag.FlagSet, root *nixconfig.NixLanguageConfig) {
+	flagSet.StringVar(&f.tracer, FLAG_TRACER, string(root.Tracer),
+		"backend tracing the files read during evaluation: fptrace or strace")
+	flagSet.StringVar(&f.tracerPath, FLAG_TRACER_PATH, root.TracerPath,
+		"path of the tracer binary, instead of looking it up in PATH, then in the runfiles")
+	flagSet.StringVar(&f.evaluator, FLAG_EVALUATOR, root.Evaluator,
+		"nix evaluator binary: a label, a path, or a name looked up in PATH")
+	flagSet.StringVar(&f.cli, FLAG_CLI, string(root.EvaluatorCLI),
+		"command line interface of the evaluator: auto, nix-instantiate or nix")
+	flagSet.IntVar(&f.jobs, FLAG_JOBS, root.Jobs,
+		"maximal number of concurrent evaluations")
+	flagSet.DurationVar(&f.timeout, FLAG_TIMEOUT, root.Timeout,
+		"maximal duration of a single evaluation, 0 for none")
+	flagSet.StringVar(&f.cacheDir, FLAG_CACHE_DIR, root.CacheDir,
+		"directory where evaluation traces are cached across runs")
+	flagSet.BoolVar(&f.keepGoing, FLAG_KEEP_GOING, root.KeepGoing,
+		"keep generating rules after a package failed to evaluate")
+	flagSet.StringVar(&f.logFormat, FLAG_LOG_FORMAT, logconfig.Format(),
+		"format of the logs: console or json")
+	flagSet.BoolVar(&f.ifdProbe, FLAG_IFD_PROBE, root.IFDProbe,
+		"evaluate packages a second time, with import-from-derivation disabled, to catch derivations realised by the daemon")
+}
+
+// apply validates the flags, and sets them in the root configuration.
+func (f *nixFlags) apply(root *nixconfig.NixLanguageConfig) error {
+	tracer, err := nixconfig.ParseTracer(f.tracer)
+	if err != nil {
+		return fmt.Errorf("%w: -%s: %v", errFlag, FLAG_TRACER, err)
+	}
+	if err := parseEvaluator(root, f.evaluator+" "+f.cli); err != nil {
+		return fmt.Errorf("%w: -%s, -%s: %v", errFlag, FLAG_EVALUATOR, FLAG_CLI, err)
+	}
+	if f.jobs < 1 {
+		return fmt.Errorf("%w: -%s must be positive", errFlag, FLAG_JOBS)
+	}
+	if f.timeout < 0 {
+		return fmt.Errorf("%w: -%s must not be negative", errFlag, FLAG_TIMEOUT)
+	}
+	if err := logconfig.SetFormat(f.logFormat); err != nil {
+		return fmt.Errorf("%w: -%s: %v", errFlag, FLAG_LOG_FORMAT, err)
+	}
+
+	root.Tracer = tracer
+	root.TracerPath = f.tracerPath
+	root.Jobs = f.jobs
+	root.Timeout = f.timeout
+	root.CacheDir = f.cacheDir
+	root.KeepGoing = f.keepGoing
+	root.IFDProbe = f.ifdProbe
+	setJobs(f.jobs)
+
+	return nil
+}
+
+// evalSlots bounds the number of concurrent evaluations.
+var evalSlots = make(chan struct{}, runtime.NumCPU())
+
+func setJobs(jobs int) {
+	evalSlots = make(chan struct{}, jobs)
+}
+
+// acquireEvalSlot blocks until an evaluation may start, and returns the
+// function releasing its slot.
+func acquireEvalSlot() func() {
+	slots := evalSlots
+	slots <- struct{}{}
+
+	return func() { <-slots }
+}
+
+// rootNixConfig returns the configuration of the repository root,
+// creating it if needed.
+func rootNixConfig(config *config.Config) *nixconfig.NixLanguageConfig {
+	return createNixConfig(config, "")
+}
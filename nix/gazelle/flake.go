@@ -0,0 +1,169 @@
+package gazelle
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/bazelbuild/bazel-gazelle/rule"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+	"github.com/rs/zerolog"
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/private/logconfig"
+)
+
+// FLAKE_FILE is the file defining a flake.
+const FLAKE_FILE = "flake.nix"
+
+// flakeExpr evaluates to the packages of the flake of a directory, for
+// the current system, or to an empty set when the flake has none. It is
+// formatted with the path of the directory.
+const flakeExpr = `((builtins.getFlake ("path:" + toString %s)).packages or { }).${builtins.currentSystem} or { }`
+
+// FLAKE_FEATURES are the experimental features flakes are evaluated
+// with.
+const FLAKE_FEATURES = "flakes nix-command"
+
+// flakeConfig returns the configuration flakes are evaluated, and built,
+// with, which enables the experimental features they require.
+func flakeConfig(nixCfg *nixconfig.NixLanguageConfig) *nixconfig.NixLanguageConfig {
+	flakeCfg := *nixCfg
+	flakeCfg.NixOptions = copyStringMap(nixCfg.NixOptions)
+	if _, ok := flakeCfg.NixOptions["extra-experimental-features"]; !ok {
+		flakeCfg.NixOptions["extra-experimental-features"] = FLAKE_FEATURES
+	}
+
+	return &flakeCfg
+}
+
+// withoutBuildFiles drops the BUILD file of the package from the labels.
+// The flake copies its whole directory, but the manifest does not depend
+// on the BUILD file it is declared in.
+func withoutBuildFiles(labels []string, sourceDirRel string) []string {
+	kept := make([]string, 0, len(labels))
+	for _, l := range labels {
+		if l != "//"+sourceDirRel+":BUILD" && l != "//"+sourceDirRel+":BUILD.bazel" {
+			kept = append(kept, l)
+		}
+	}
+
+	return kept
+}
+
+// discoverFlakePackages evaluates the names of the packages of the flake
+// located in dir.
+func discoverFlakePackages(
+	logger *zerolog.Logger,
+	nixCfg *nixconfig.NixLanguageConfig,
+	workspaceRoot string,
+	dir string,
+) (_ []string, err error) {
+	le := &LogEvent{
+		Path: filepath.Join(dir, FLAKE_FILE),
+	}
+
+	defer err2.Handle(&err, func() {
+		le.Error = err
+		le.Send(logger)
+	})
+
+	env := try.To1(newEvalEnvironment(nixCfg))
+	defer env.Close()
+
+	ev := try.To1(newEvaluator(workspaceRoot, nixCfg))
+	expr := "builtins.attrNames " + fmt.Sprintf(flakeExpr, nixString(dir))
+	command := newExprEvalCommand(workspaceRoot, nixCfg, ev, expr)
+
+	var stdout, stderr bytes.Buffer
+	cmd, runErr := command.run(env, nixCfg.Timeout, &stdout, &stderr)
+
+	defer err2.Handle(&err, func() {
+		le.Details = stderr.Bytes()
+		le.Command = strings.Join(cmd.Args, " ")
+		le.SetMessage("evaluation of the flake packages failed")
+	})
+	try.To(runErr)
+
+	var names []string
+	try.To(json.Unmarshal(stdout.Bytes(), &names))
+
+	return names, nil
+}
+
+// FlakeToNixRules generates a manifest for every package of the flake
+// located in the sourceDirRel directory, for the current system.
+func FlakeToNixRules(
+	workspaceRoot string,
+	sourceDirRel string,
+	nixCfg *nixconfig.NixLanguageConfig,
+	wg *sync.WaitGroup,
+	rules chan<- *rule.Rule) {
+	defer wg.Done()
+
+	var logger = logconfig.GetLogger()
+
+	defer err2.Catch(func(err error) {
+		stopUnlessKeepGoing(logger, nixCfg, err)
+	})
+
+	nixCfg = flakeConfig(nixCfg)
+	dir := filepath.Join(workspaceRoot, sourceDirRel)
+	flakeFile := filepath.Join(dir, FLAKE_FILE)
+	names := try.To1(discoverFlakePackages(logger, nixCfg, workspaceRoot, dir))
+
+	var components []string
+	if sourceDirRel != "" {
+		components = strings.Split(sourceDirRel, "/")
+	}
+	// The flake is copied along with the nix_file_deps of the manifest,
+	// at the same workspace relative location
+	flakeDir := "./" + sourceDirRel
+	if sourceDirRel == "" {
+		flakeDir = "./."
+	}
+
+	for _, name := range names {
+		attrPath := formatAttrPath([]string{name})
+
+		logger.Info().
+			Str("file", filepath.Join(sourceDirRel, FLAKE_FILE)).
+			Str("attribute", attrPath).
+			Msg("parsing nix attribute")
+
+		pkgName := repositoryName(nixCfg, name, append(components[:len(components):len(components)], name))
+		claimRepositoryName(logger, pkgName, fmt.Sprintf("//%s (%s)", sourceDirRel, attrPath))
+
+		directDeps, externalDeps := try.To2(nixToDepSets(
+			logger,
+			workspaceRoot,
+			nixCfg,
+			flakeFile,
+			evalTarget{
+				expr:     fmt.Sprintf(flakeExpr, nixString(dir)),
+				attrPath: attrPath,
+			},
+		))
+
+		nrap := &NixRuleArgs{
+			kind: MANIFEST_RULE,
+			attrs: map[string]interface{}{
+				"name":             pkgName,
+				"nix_file_deps":    append(externalDeps, withoutBuildFiles(directDeps, sourceDirRel)...),
+				"nix_file_content": fmt.Sprintf(flakeExpr, flakeDir),
+				"repositories":     nixCfg.NixRepositories,
+				"attribute_path":   attrPath,
+			},
+			comments: []string{
+				"# autogenerated",
+			},
+		}
+
+		setManifestAttrs(nixCfg, name, nrap)
+
+		rules <- genNixRule(nrap)
+	}
+}
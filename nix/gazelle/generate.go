@@ -3,15 +3,18 @@ package gazelle
 import (
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
 	"github.com/bazelbuild/bazel-gazelle/language"
+	"github.com/bazelbuild/bazel-gazelle/pathtools"
 	"github.com/bazelbuild/bazel-gazelle/rule"
 	"github.com/lainio/err2"
 	"github.com/lainio/err2/try"
+	"github.com/rs/zerolog"
 	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
 	"github.com/tweag/nix_gazelle_extension/nix/gazelle/private/logconfig"
 )
@@ -33,9 +36,38 @@ func genNixRule(args *NixRuleArgs) *rule.Rule {
 	return r
 }
 
+// exportsName returns the name of the filegroup exporting the files of
+// the nix package located in the rel directory. Unlike repository names,
+// it only depends on the directory, so that nested packages can be
+// referred to without their configuration.
+func exportsName(rel string) string {
+	return fmt.Sprintf("%s-exports", strings.ReplaceAll(rel, "/", "."))
+}
+
+// nixAttributePath returns the attribute path of the nix package located
+// in the rel directory, relative to the root of its prelude, and rooted
+// under the attribute prefix of the prelude.
+func nixAttributePath(nixCfg *nixconfig.NixLanguageConfig, rel string) string {
+	attrPath := strings.ReplaceAll(pathtools.TrimPrefix(rel, nixCfg.NixPreludeRoot), "/", ".")
+	if nixCfg.NixPreludeAttrPrefix == "" {
+		return attrPath
+	}
+	if attrPath == "" {
+		return nixCfg.NixPreludeAttrPrefix
+	}
+
+	return nixCfg.NixPreludeAttrPrefix + "." + attrPath
+}
+
+// fileLabel returns the label of a file, given its workspace relative
+// path, assuming its directory is a Bazel package.
+func fileLabel(rel string) string {
+	return fmt.Sprintf("//%s:%s", parentPackage(rel), path.Base(rel))
+}
+
 func SourceFileToNixRules(
+	workspaceRoot string,
 	sourceFile string,
-	sourceDirAbs string,
 	sourceDirRel string,
 	nixCfg *nixconfig.NixLanguageConfig,
 	wg *sync.WaitGroup,
@@ -55,15 +87,48 @@ func SourceFileToNixRules(
 		Str("file", filepath.Join(sourceDirRel, sourceFile)).
 		Msg("parsing nix file")
 
-	pth := filepath.Join(sourceDirAbs, sourceFile)
+	pth := filepath.Join(workspaceRoot, sourceDirRel, sourceFile)
 
 	defer err2.Catch(func(err error) {
-		logger.Error().Err(err)
+		stopUnlessKeepGoing(logger, nixCfg, err)
 	})
 
-	pkgName := strings.ReplaceAll(sourceDirRel, "/", ".")
+	pkgName := nixPackageName(nixCfg, sourceDirRel)
+	attrPath := nixAttributePath(nixCfg, sourceDirRel)
+	if usesPrelude(nixCfg) && len(nixCfg.AttributeDiscovery) > 0 {
+		attrPaths := try.To1(discoverPreludeAttributes(logger, nixCfg, workspaceRoot))
+
+		var found bool
+		if attrPath, found = attrPaths[sourceDirRel]; !found {
+			logger.Warn().
+				Str("package", sourceDirRel).
+				Str("prelude", nixCfg.NixPrelude).
+				Msg("no attribute of the prelude is defined in the directory, skipping")
+			return
+		}
+	} else if usesPrelude(nixCfg) {
+		reachability := try.To1(reachablePreludePackages(logger, nixCfg, workspaceRoot))
+
+		if reachable, found := reachability[attrPath]; found && !reachable {
+			logger.Warn().
+				Str("package", sourceDirRel).
+				Str("attribute", attrPath).
+				Str("prelude", nixCfg.NixPrelude).
+				Msg("package is not reachable from the prelude, skipping")
+			return
+		}
+	}
+
+	// Skipped packages generate no rule, so they claim no name
+	claimRepositoryName(logger, pkgName, "//"+sourceDirRel)
 
-	directDeps, externalDeps := try.To2(nixToDepSets(logger, nixCfg.NixPrelude, nixCfg.NixPath, pth, pkgName))
+	directDeps, externalDeps := try.To2(nixToDepSets(
+		logger,
+		workspaceRoot,
+		nixCfg,
+		pth,
+		packageEvalTarget(workspaceRoot, nixCfg, pth, attrPath),
+	))
 
 	// TODO: instead of using template file
 	// use already existing/generated one.
@@ -87,9 +152,11 @@ func SourceFileToNixRules(
 		},
 	}
 
-	if len(nixCfg.NixPrelude) > 0 {
-		nrap.attrs["nix_file"] = fmt.Sprintf("//:%s", nixCfg.NixPrelude)
-		nrap.attrs["attribute_path"] = pkgName
+	setManifestAttrs(nixCfg, "", nrap)
+
+	if usesPrelude(nixCfg) {
+		nrap.attrs["nix_file"] = nixCfg.NixPreludeLabel
+		nrap.attrs["attribute_path"] = attrPath
 	} else {
 		nrap.attrs["nix_file"] = fmt.Sprintf("//%s:%s", sourceDirRel, sourceFile)
 	}
@@ -107,7 +174,7 @@ func SourceFileToNixRules(
 	nrae := &NixRuleArgs{
 		kind: EXPORT_RULE,
 		attrs: map[string]interface{}{
-			"name": fmt.Sprintf("%s-exports", pkgName),
+			"name": exportsName(sourceDirRel),
 			"srcs": directDeps,
 		},
 		comments: []string{
@@ -115,7 +182,95 @@ func SourceFileToNixRules(
 		},
 	}
 
+	setExportsAttrs(nixCfg, nrae)
+
 	rules <- genNixRule(nrae)
+	recordExports(sourceDirRel)
+}
+
+// stopUnlessKeepGoing aborts the run when a package failed, unless the
+// configuration asks to keep going. Failures are logged where they
+// happen.
+func stopUnlessKeepGoing(
+	logger *zerolog.Logger,
+	nixCfg *nixconfig.NixLanguageConfig,
+	err error,
+) {
+	if !nixCfg.KeepGoing {
+		logger.Fatal().
+			Err(err).
+			Msg("stopping after the first failure, as keep going is disabled")
+	}
+}
+
+// DiscoveredToNixRules generates a manifest for every derivation of the
+// configured overlay, or attribute set, which is defined in the
+// sourceDirRel directory.
+func DiscoveredToNixRules(
+	workspaceRoot string,
+	sourceDirRel string,
+	nixCfg *nixconfig.NixLanguageConfig,
+	wg *sync.WaitGroup,
+	rules chan<- *rule.Rule) {
+	defer wg.Done()
+
+	var logger = logconfig.GetLogger()
+
+	defer err2.Catch(func(err error) {
+		stopUnlessKeepGoing(logger, nixCfg, err)
+	})
+
+	discovery := nixCfg.Discovery
+	derivations := try.To1(discoverConfiguredDerivations(logger, nixCfg, workspaceRoot))
+
+	for _, d := range derivations {
+		if pathtools.TrimPrefix(filepath.Dir(d.file()), workspaceRoot) != sourceDirRel {
+			continue
+		}
+
+		logger.Info().
+			Str("file", pathtools.TrimPrefix(d.file(), workspaceRoot)).
+			Str("attribute", formatAttrPath(d.AttrPath)).
+			Msg("parsing nix attribute")
+
+		name := repositoryName(nixCfg, strings.Join(d.AttrPath, "."), d.AttrPath)
+		claimRepositoryName(logger, name, fmt.Sprintf("//%s (%s)", sourceDirRel, formatAttrPath(d.AttrPath)))
+
+		directDeps, externalDeps := try.To2(nixToDepSets(
+			logger,
+			workspaceRoot,
+			nixCfg,
+			d.file(),
+			discoveredEvalTarget(workspaceRoot, discovery, d),
+		))
+
+		nrap := &NixRuleArgs{
+			kind: MANIFEST_RULE,
+			attrs: map[string]interface{}{
+				"name":           name,
+				"nix_file_deps":  append(externalDeps, directDeps...),
+				"repositories":   nixCfg.NixRepositories,
+				"attribute_path": discoveredAttrPath(discovery, d),
+			},
+			comments: []string{
+				"# autogenerated",
+			},
+		}
+
+		setManifestAttrs(nixCfg, strings.Join(d.AttrPath, "."), nrap)
+
+		if discovery.Kind == nixconfig.DISCOVERY_OVERLAY {
+			nrap.attrs["nix_file_content"] = fmt.Sprintf(
+				overlayExpr,
+				"./"+discovery.File,
+				discovery.Arg,
+			)
+		} else {
+			nrap.attrs["nix_file"] = discovery.Label
+		}
+
+		rules <- genNixRule(nrap)
+	}
 }
 
 // GenerateRules extracts build metadata from source files in a directory.
@@ -149,7 +304,21 @@ func (nixLang *nixLang) GenerateRules(
 			Msgf("Cannot extract configs")
 	})
 
+	recordVisit(args.Rel)
+
 	cfg := try.To1(GetNixConfig(args.Config, args.Rel))
+	if !cfg.Enabled {
+		logger.Debug().Msg("generation is disabled")
+		return language.GenerateResult{}
+	}
+	if cfg.Ignored {
+		logger.Debug().Msg("directory is ignored")
+		return language.GenerateResult{}
+	}
+
+	files := append(args.RegularFiles, args.GenFiles...)
+	mode := try.To1(resolveMode(cfg))
+	workspaceRoot := workspaceRootOf(args.Config)
 
 	var wg sync.WaitGroup
 	var rules = make(chan *rule.Rule)
@@ -159,9 +328,20 @@ func (nixLang *nixLang) GenerateRules(
 		close(rules)
 	}()
 
-	for _, sourceFile := range append(args.RegularFiles, args.GenFiles...) {
+	switch mode {
+	case nixconfig.MODE_OVERLAY:
 		wg.Add(1)
-		go SourceFileToNixRules(sourceFile, args.Dir, args.Rel, cfg, &wg, rules)
+		go DiscoveredToNixRules(workspaceRoot, args.Rel, cfg, &wg, rules)
+	case nixconfig.MODE_FLAKE:
+		if hasFile(files, FLAKE_FILE) {
+			wg.Add(1)
+			go FlakeToNixRules(workspaceRoot, args.Rel, cfg, &wg, rules)
+		}
+	default:
+		for _, sourceFile := range files {
+			wg.Add(1)
+			go SourceFileToNixRules(workspaceRoot, sourceFile, args.Rel, cfg, &wg, rules)
+		}
 	}
 
 	var res language.GenerateResult
@@ -179,6 +359,16 @@ func (nixLang *nixLang) GenerateRules(
 	return res
 }
 
+// workspaceRootOf returns the root of the workspace, as seen by the
+// traced processes, i.e. with symbolic links resolved.
+func workspaceRootOf(c *config.Config) string {
+	if root, err := filepath.EvalSymlinks(c.RepoRoot); err == nil {
+		return root
+	}
+
+	return c.RepoRoot
+}
+
 func fileExists(filename string) bool {
 	info, err := os.Stat(filename)
 	if os.IsNotExist(err) {
@@ -187,3 +377,9 @@ func fileExists(filename string) bool {
 
 	return !info.IsDir()
 }
+
+// isDirectory tells if the path exists, and is a directory.
+func isDirectory(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
@@ -0,0 +1,92 @@
+package gazelle
+
+import (
+	"bytes"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	gitTrackedFiles      = make(map[string][]string)
+	gitTrackedFilesMutex sync.Mutex
+)
+
+// isGitPath tells if the path points into a .git directory, whose files
+// must never be used as labels.
+func isGitPath(filePath string) bool {
+	for _, part := range strings.Split(filePath, string(filepath.Separator)) {
+		if part == ".git" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// gitDirectories returns the directories whose git-tracked files were
+// looked up during evaluation, e.g. by builtins.fetchGit ./. or
+// lib.fileset.gitTracked. They are the working directories of the traced
+// git processes, if any, and otherwise the directory of the package.
+func gitDirectories(outputs *TraceOuts, packageDir string) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	add := func(dir string) {
+		if dir != "" && !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	for _, output := range *outputs {
+		if filepath.Base(output.Cmd.Path) != "git" {
+			continue
+		}
+
+		dir := output.Cmd.Dir
+		for i, arg := range output.Cmd.Args {
+			if arg == "-C" && i+1 < len(output.Cmd.Args) {
+				dir = output.Cmd.Args[i+1]
+				if !filepath.IsAbs(dir) {
+					dir = filepath.Join(output.Cmd.Dir, dir)
+				}
+			}
+		}
+		add(dir)
+	}
+
+	if len(dirs) == 0 {
+		add(packageDir)
+	}
+
+	return dirs
+}
+
+// listGitTracked returns the absolute paths of the files tracked by git
+// under the directory. Results are cached for the duration of the run.
+func listGitTracked(dir string) ([]string, error) {
+	gitTrackedFilesMutex.Lock()
+	defer gitTrackedFilesMutex.Unlock()
+
+	if files, ok := gitTrackedFiles[dir]; ok {
+		return files, nil
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command("git", "-C", dir, "ls-files", "-z")
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, rel := range strings.Split(stdout.String(), "\x00") {
+		if rel != "" {
+			files = append(files, filepath.Join(dir, rel))
+		}
+	}
+	gitTrackedFiles[dir] = files
+
+	return files, nil
+}
@@ -0,0 +1,46 @@
+package gazelle
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestListGitTracked(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	dir := t.TempDir()
+	for _, file := range []string{"README.md", "pkg/default.nix", "pkg/src/main.c", "other/default.nix"} {
+		filePath := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filePath, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{{"init", "-q"}, {"add", "."}} {
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+
+	files, err := listGitTracked(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, filePath := range files {
+		rel, _ := filepath.Rel(dir, filePath)
+		got = append(got, rel)
+	}
+	want := []string{"README.md", "other/default.nix", "pkg/default.nix", "pkg/src/main.c"}
+	if !equalStrings(got, want) {
+		t.Errorf("listGitTracked() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,47 @@
+package gazelle
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// equalStrings tells whether both slices hold the same strings, in the
+// same order, treating nil and empty slices alike.
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeWorkspace creates the files, given by workspace relative path,
+// in a temporary workspace, and returns its root.
+func writeWorkspace(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	workspaceRoot := t.TempDir()
+	for file, content := range files {
+		writeFile(t, filepath.Join(workspaceRoot, file), content)
+	}
+
+	return workspaceRoot
+}
+
+// writeFile writes the file, creating its parent directories.
+func writeFile(t *testing.T, filePath string, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
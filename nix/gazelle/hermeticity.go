@@ -0,0 +1,284 @@
+package gazelle
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/pathtools"
+	"github.com/rs/zerolog"
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+var errHermeticity = errors.New("evaluation is not hermetic")
+
+// writeViolation is a file written by a traced process, during
+// evaluation, to a location it is not supposed to touch.
+type writeViolation struct {
+	path    string
+	process string
+}
+
+// findWrites returns the writes made inside the workspace, or inside any
+// of the sensitive locations, by the processes of the evaluation.
+func findWrites(
+	workspaceRoot string,
+	sensitivePaths []string,
+	outputs *TraceOuts,
+) []writeViolation {
+	if outputs == nil {
+		return nil
+	}
+
+	// An empty prefix would match every path, and report every write
+	var guarded []string
+	if workspaceRoot != "" {
+		guarded = append(guarded, filepath.Clean(workspaceRoot))
+	}
+	for _, p := range expandHomePaths(sensitivePaths) {
+		if p != "" && p != "." {
+			guarded = append(guarded, p)
+		}
+	}
+	if len(guarded) == 0 {
+		return nil
+	}
+	tree := newProcessTree(outputs)
+
+	var violations []writeViolation
+	for i := range *outputs {
+		output := &(*outputs)[i]
+		for _, filePath := range output.Outputs {
+			for _, prefix := range guarded {
+				if pathtools.HasPrefix(filePath, prefix) {
+					violations = append(violations, writeViolation{
+						path:    filePath,
+						process: tree.lineage(output),
+					})
+					break
+				}
+			}
+		}
+	}
+
+	return violations
+}
+
+func expandHomePaths(paths []string) []string {
+	home, _ := os.UserHomeDir()
+	expanded := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if home != "" && (p == "~" || strings.HasPrefix(p, "~/")) {
+			p = filepath.Join(home, strings.TrimPrefix(p, "~"))
+		}
+		expanded = append(expanded, filepath.Clean(p))
+	}
+
+	return expanded
+}
+
+// reportWrites logs the writes according to the policy, and returns
+// errHermeticity if the policy requires the package to fail.
+func reportWrites(
+	logger *zerolog.Logger,
+	policy nixconfig.Policy,
+	nixFile string,
+	violations []writeViolation,
+) error {
+	if len(violations) == 0 || policy == nixconfig.POLICY_IGNORE {
+		return nil
+	}
+
+	for _, v := range violations {
+		event := logger.Warn()
+		if policy == nixconfig.POLICY_ERROR {
+			event = logger.Error()
+		}
+		event.
+			Str("package", nixFile).
+			Str("process", v.process).
+			Str("write", v.path).
+			Msg("evaluation wrote to a guarded location")
+	}
+
+	if policy == nixconfig.POLICY_ERROR {
+		return fmt.Errorf("%w: %d write(s) during evaluation", errHermeticity, len(violations))
+	}
+
+	return nil
+}
+
+// readOnlyWorkspace wraps the command so that it sees the workspace
+// through a read-only bind mount. It relies on bubblewrap being
+// available in PATH.
+func readOnlyWorkspace(workspaceRoot string, command []string) ([]string, error) {
+	bwrap, err := exec.LookPath("bwrap")
+	if err != nil {
+		return nil, fmt.Errorf("read-only workspace requires bwrap in PATH: %w", err)
+	}
+
+	return append(
+		[]string{
+			bwrap,
+			"--dev-bind", "/", "/",
+			"--ro-bind", workspaceRoot, workspaceRoot,
+			"--",
+		},
+		command...,
+	), nil
+}
+
+// pseudoFilesystems are never reported as inputs, as they do not hold
+// files an evaluation could depend on.
+var pseudoFilesystems = []string{"/proc", "/dev", "/sys", "/run"}
+
+// externalInput is a file read by a traced process from outside of the
+// workspace.
+type externalInput struct {
+	path    string
+	class   nixconfig.InputClass
+	process string
+}
+
+func classifyInput(home string, filePath string) nixconfig.InputClass {
+	switch {
+	case pathtools.HasPrefix(filePath, "/nix/store"):
+		return nixconfig.INPUT_STORE
+	case pathtools.HasPrefix(filePath, "/etc"):
+		return nixconfig.INPUT_SYSTEM_CONFIG
+	case home != "" && pathtools.HasPrefix(filePath, home):
+		return nixconfig.INPUT_USER_CONFIG
+	}
+
+	return nixconfig.INPUT_OTHER
+}
+
+// collectExternalInputs returns the classified inputs located outside of
+// the workspace, and of the known external repositories, read by the
+// processes kept by the filter.
+func collectExternalInputs(
+	labels *labeler,
+	outputs *TraceOuts,
+	filter processFilter,
+) []externalInput {
+	if outputs == nil {
+		return nil
+	}
+
+	home, _ := os.UserHomeDir()
+	tree := newProcessTree(outputs)
+	seen := make(map[string]bool)
+
+	var inputs []externalInput
+	for i := range *outputs {
+		output := &(*outputs)[i]
+		if !filter.keeps(tree, output) {
+			continue
+		}
+
+		for _, filePath := range output.Inputs {
+			if seen[filePath] || isPseudoFile(filePath) || isDirectory(filePath) {
+				continue
+			}
+			if _, tracked := labels.label(filePath, false); tracked {
+				continue
+			}
+			seen[filePath] = true
+
+			inputs = append(inputs, externalInput{
+				path:    filePath,
+				class:   classifyInput(home, filePath),
+				process: tree.lineage(output),
+			})
+		}
+	}
+
+	return inputs
+}
+
+func isPseudoFile(filePath string) bool {
+	for _, prefix := range pseudoFilesystems {
+		if pathtools.HasPrefix(filePath, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isAllowedInput tells if the path, or any of its parent directories,
+// matches one of the allowlisted patterns.
+func isAllowedInput(patterns []string, filePath string) bool {
+	patterns = expandHomePaths(patterns)
+	for dir := filePath; ; dir = filepath.Dir(dir) {
+		for _, pattern := range patterns {
+			if ok, _ := filepath.Match(pattern, dir); ok {
+				return true
+			}
+		}
+		if dir == filepath.Dir(dir) {
+			return false
+		}
+	}
+}
+
+// reportExternalInputs logs a classified report of the inputs from
+// outside of the workspace, and returns errHermeticity if any of the
+// inputs, which are not allowlisted, belongs to a class whose policy
+// requires the package to fail.
+func reportExternalInputs(
+	logger *zerolog.Logger,
+	nixCfg *nixconfig.NixLanguageConfig,
+	nixFile string,
+	inputs []externalInput,
+) error {
+	byClass := make(map[nixconfig.InputClass][]externalInput)
+	for _, input := range inputs {
+		byClass[input.class] = append(byClass[input.class], input)
+	}
+
+	summary := logger.Debug().Str("package", nixFile)
+	for _, class := range nixconfig.InputClasses {
+		summary = summary.Int(string(class), len(byClass[class]))
+	}
+	summary.Msg("inputs from outside of the workspace")
+
+	var failures int
+	for _, class := range nixconfig.InputClasses {
+		policy := nixCfg.ExternalInputPolicies[class]
+		for _, input := range byClass[class] {
+			allowed := isAllowedInput(nixCfg.ExternalInputAllow, input.path)
+
+			var event *zerolog.Event
+			switch {
+			case allowed || policy == nixconfig.POLICY_IGNORE:
+				event = logger.Trace()
+			case policy == nixconfig.POLICY_WARN:
+				event = logger.Warn()
+			default:
+				event = logger.Error()
+				failures++
+			}
+			event.
+				Str("package", nixFile).
+				Str("class", string(class)).
+				Str("process", input.process).
+				Bool("allowed", allowed).
+				Str("input", input.path).
+				Msg("input from outside of the workspace")
+		}
+	}
+
+	if failures > 0 {
+		return fmt.Errorf(
+			"%w: %d input(s) from outside of the workspace",
+			errHermeticity,
+			failures,
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package gazelle
+
+import (
+	"testing"
+
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+func TestFindWrites(t *testing.T) {
+	outputs := TraceOuts{
+		{
+			Cmd:     TraceCmd{ID: 1, Path: "/bin/nix-instantiate"},
+			Outputs: []string{"/ws/result", "/tmp/scratch", "/etc/nix/secret"},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		workspaceRoot  string
+		sensitivePaths []string
+		want           []string
+	}{
+		{
+			name:          "workspace writes",
+			workspaceRoot: "/ws",
+			want:          []string{"/ws/result"},
+		},
+		{
+			name:           "sensitive paths",
+			workspaceRoot:  "/ws",
+			sensitivePaths: []string{"/etc/nix"},
+			want:           []string{"/ws/result", "/etc/nix/secret"},
+		},
+		{
+			name:          "empty workspace root",
+			workspaceRoot: "",
+			want:          nil,
+		},
+		{
+			name:           "empty sensitive path",
+			sensitivePaths: []string{""},
+			want:           nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations := findWrites(tt.workspaceRoot, tt.sensitivePaths, &outputs)
+
+			var got []string
+			for _, v := range violations {
+				got = append(got, v.path)
+			}
+			if !equalStrings(got, tt.want) {
+				t.Errorf("findWrites() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyInput(t *testing.T) {
+	tests := []struct {
+		home     string
+		filePath string
+		want     nixconfig.InputClass
+	}{
+		{home: "/home/user", filePath: "/nix/store/00000000000000000000000000000000-source", want: nixconfig.INPUT_STORE},
+		{home: "/home/user", filePath: "/etc/nix/nix.conf", want: nixconfig.INPUT_SYSTEM_CONFIG},
+		{home: "/home/user", filePath: "/home/user/.config/nixpkgs/config.nix", want: nixconfig.INPUT_USER_CONFIG},
+		{home: "/home/user", filePath: "/home/username/default.nix", want: nixconfig.INPUT_OTHER},
+		{home: "/home/user", filePath: "/etcetera/default.nix", want: nixconfig.INPUT_OTHER},
+		{home: "", filePath: "/home/user/.config/nixpkgs/config.nix", want: nixconfig.INPUT_OTHER},
+		{home: "/home/user", filePath: "/opt/default.nix", want: nixconfig.INPUT_OTHER},
+	}
+
+	for _, tt := range tests {
+		if got := classifyInput(tt.home, tt.filePath); got != tt.want {
+			t.Errorf("classifyInput(%q, %q) = %s, want %s", tt.home, tt.filePath, got, tt.want)
+		}
+	}
+}
+
+func TestIsAllowedInput(t *testing.T) {
+	t.Setenv("HOME", "/home/user")
+
+	tests := []struct {
+		patterns []string
+		filePath string
+		want     bool
+	}{
+		{patterns: []string{"/etc/nix"}, filePath: "/etc/nix/nix.conf", want: true},
+		{patterns: []string{"/etc/nix/"}, filePath: "/etc/nix/nix.conf", want: true},
+		{patterns: []string{"/etc/nix"}, filePath: "/etc/nixos/configuration.nix", want: false},
+		{patterns: []string{"/opt/*/share"}, filePath: "/opt/tool/share/default.nix", want: true},
+		{patterns: []string{"/opt/*/share"}, filePath: "/opt/tool/lib/default.nix", want: false},
+		{patterns: []string{"/"}, filePath: "/any/file", want: true},
+		{patterns: nil, filePath: "/etc/nix/nix.conf", want: false},
+		{patterns: []string{"~/.config/nixpkgs"}, filePath: "/home/user/.config/nixpkgs/config.nix", want: true},
+		{patterns: []string{"~/.config/nixpkgs"}, filePath: "/root/.config/nixpkgs/config.nix", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isAllowedInput(tt.patterns, tt.filePath); got != tt.want {
+			t.Errorf("isAllowedInput(%q, %q) = %t, want %t", tt.patterns, tt.filePath, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package gazelle
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+var (
+	// storePathRegex matches the top-level store path of a file in the
+	// nix store.
+	storePathRegex = regexp.MustCompile(`^/nix/store/[0-9a-z]{32}-[^/]+`)
+	// disabledIFDRegex matches the error reported by the evaluator when
+	// it refuses to realise a derivation during evaluation. Recent
+	// versions suffix the derivation with the outputs to realise.
+	disabledIFDRegex = regexp.MustCompile(
+		`cannot build '(/nix/store/[^'^]+\.drv)[^']*' during evaluation because the option 'allow-import-from-derivation' is disabled`,
+	)
+	// drvOutputRegex matches an output of a derivation file, capturing
+	// its store path.
+	drvOutputRegex = regexp.MustCompile(`\("[^"]*","(/nix/store/[0-9a-z]{32}-[^"]+)"`)
+)
+
+// ifdArgs returns the evaluator arguments required by the policy. Failing
+// on import-from-derivation disables it altogether, so that the
+// evaluator does not realise anything.
+func ifdArgs(policy nixconfig.Policy) []string {
+	if policy != nixconfig.POLICY_ERROR {
+		return nil
+	}
+
+	return []string{"--option", "allow-import-from-derivation", "false"}
+}
+
+// storePathsOf returns the sorted top-level store paths of the inputs.
+func storePathsOf(inputs []externalInput) []string {
+	seen := make(map[string]bool)
+
+	var storePaths []string
+	for _, input := range inputs {
+		if input.class != nixconfig.INPUT_STORE {
+			continue
+		}
+		storePath := storePathRegex.FindString(input.path)
+		if storePath != "" && !seen[storePath] {
+			seen[storePath] = true
+			storePaths = append(storePaths, storePath)
+		}
+	}
+	sort.Strings(storePaths)
+
+	return storePaths
+}
+
+// derivationOutputs returns the store paths of the outputs declared by
+// the derivation file, in the ATerm format of the store.
+func derivationOutputs(drvContent []byte) []string {
+	content := string(drvContent)
+	if !strings.HasPrefix(content, "Derive([") {
+		return nil
+	}
+	// The outputs are the first list, followed by the input derivations
+	content = strings.TrimPrefix(content, "Derive([")
+	if i := strings.Index(content, "],["); i >= 0 {
+		content = content[:i]
+	}
+
+	var outputs []string
+	for _, match := range drvOutputRegex.FindAllStringSubmatch(content, -1) {
+		outputs = append(outputs, match[1])
+	}
+
+	return outputs
+}
+
+// ifdFromTrace returns the derivations whose outputs the evaluator read,
+// among the derivation files accessed during evaluation. It does not
+// depend on whether the outputs were built, substituted, or already
+// valid. Reads made by other processes, such as builders, are left out.
+func ifdFromTrace(
+	outputs *TraceOuts,
+	evaluatorName string,
+	readFile func(string) ([]byte, error),
+) []string {
+	if outputs == nil {
+		return nil
+	}
+
+	drvOutputs := make(map[string]string)
+	for _, output := range *outputs {
+		for _, filePath := range append(output.Inputs, output.Outputs...) {
+			if !strings.HasSuffix(filePath, ".drv") || !storePathRegex.MatchString(filePath) {
+				continue
+			}
+			if _, seen := drvOutputs[filePath]; seen {
+				continue
+			}
+			drvOutputs[filePath] = ""
+			content, err := readFile(filePath)
+			if err != nil {
+				continue
+			}
+			for _, out := range derivationOutputs(content) {
+				drvOutputs[out] = filePath
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	var drvs []string
+	for _, output := range *outputs {
+		if filepath.Base(output.Cmd.Path) != evaluatorName {
+			continue
+		}
+		for _, filePath := range output.Inputs {
+			drv := drvOutputs[storePathRegex.FindString(filePath)]
+			if drv != "" && !seen[drv] {
+				seen[drv] = true
+				drvs = append(drvs, drv)
+			}
+		}
+	}
+	sort.Strings(drvs)
+
+	return drvs
+}
+
+// disabledIFDDerivations returns the derivations the evaluator refused
+// to realise, because import-from-derivation was disabled.
+func disabledIFDDerivations(evaluatorOutput []byte) []string {
+	seen := make(map[string]bool)
+
+	var drvs []string
+	for _, match := range disabledIFDRegex.FindAllSubmatch(evaluatorOutput, -1) {
+		drv := string(match[1])
+		if !seen[drv] {
+			seen[drv] = true
+			drvs = append(drvs, drv)
+		}
+	}
+
+	return drvs
+}
+
+// probeIFD evaluates the target again, untraced, with
+// import-from-derivation disabled, and returns the derivations the
+// evaluator refused to realise. Unlike the trace, it catches derivations
+// realised through the daemon, whose files the evaluator never reads.
+func probeIFD(
+	workspaceRoot string,
+	nixCfg *nixconfig.NixLanguageConfig,
+	ev *evaluator,
+	env *evalEnvironment,
+	target evalTarget,
+) []string {
+	probeCfg := *nixCfg
+	probeCfg.IFDPolicy = nixconfig.POLICY_ERROR
+	command := newEvalCommand(workspaceRoot, &probeCfg, ev, target)
+
+	var output bytes.Buffer
+	if _, err := command.run(env, nixCfg.Timeout, &output, &output); err == nil {
+		return nil
+	}
+
+	return disabledIFDDerivations(output.Bytes())
+}
+
+// reportIFD logs the store paths the package depends on, and the
+// derivations imported from during its evaluation. It returns
+// errHermeticity when the package uses import-from-derivation, and the
+// policy requires it to fail.
+func reportIFD(
+	logger *zerolog.Logger,
+	policy nixconfig.Policy,
+	nixFile string,
+	storePaths []string,
+	drvs []string,
+) error {
+	logger.Debug().
+		Str("package", nixFile).
+		Strs("store_paths", storePaths).
+		Msg("store paths read during evaluation")
+
+	if len(drvs) == 0 || policy == nixconfig.POLICY_IGNORE {
+		return nil
+	}
+
+	event := logger.Warn()
+	if policy == nixconfig.POLICY_ERROR {
+		event = logger.Error()
+	}
+	event.
+		Str("package", nixFile).
+		Strs("derivations", drvs).
+		Msg("evaluation uses import-from-derivation")
+
+	if policy == nixconfig.POLICY_ERROR {
+		return fmt.Errorf("%w: import-from-derivation of %d derivation(s)", errHermeticity, len(drvs))
+	}
+
+	return nil
+}
+
+// reportDisabledIFD logs the derivations the evaluator refused to
+// realise, because import-from-derivation was disabled.
+func reportDisabledIFD(logger *zerolog.Logger, nixFile string, evaluatorOutput []byte) {
+	for _, drv := range disabledIFDDerivations(evaluatorOutput) {
+		logger.Error().
+			Str("package", nixFile).
+			Str("derivation", drv).
+			Msg("evaluation uses import-from-derivation, which is not allowed")
+	}
+}
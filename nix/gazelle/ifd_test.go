@@ -0,0 +1,152 @@
+package gazelle
+
+import (
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+const (
+	testDrv    = "/nix/store/0000000000000000000000000000000a-gen.drv"
+	testOut    = "/nix/store/0000000000000000000000000000000b-gen"
+	testDevOut = "/nix/store/0000000000000000000000000000000c-gen-dev"
+	testSrc    = "/nix/store/0000000000000000000000000000000d-source"
+)
+
+var testDrvContent = `Derive([("dev","` + testDevOut + `","",""),("out","` + testOut + `","","")],` +
+	`[("/nix/store/0000000000000000000000000000000e-bash.drv",["out"])],` +
+	`["` + testSrc + `"],"x86_64-linux","/bin/sh",[],` +
+	`[("out","` + testOut + `"),("src","` + testSrc + `")])`
+
+func TestDerivationOutputs(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{
+			name:    "outputs only",
+			content: testDrvContent,
+			want:    []string{testDevOut, testOut},
+		},
+		{
+			name:    "not a derivation",
+			content: `{ "out": "` + testOut + `" }`,
+			want:    nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := derivationOutputs([]byte(tt.content)); !equalStrings(got, tt.want) {
+				t.Errorf("derivationOutputs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIFDFromTrace(t *testing.T) {
+	readFile := func(filePath string) ([]byte, error) {
+		if filePath == testDrv {
+			return []byte(testDrvContent), nil
+		}
+		return nil, os.ErrNotExist
+	}
+
+	tests := []struct {
+		name    string
+		outputs TraceOuts
+		want    []string
+	}{
+		{
+			name: "evaluator reads an output",
+			outputs: TraceOuts{
+				{
+					Cmd:     TraceCmd{ID: 1, Path: "/usr/bin/nix-instantiate"},
+					Inputs:  []string{testSrc + "/default.nix", testOut + "/generated.nix"},
+					Outputs: []string{testDrv},
+				},
+			},
+			want: []string{testDrv},
+		},
+		{
+			name: "builder reads an output",
+			outputs: TraceOuts{
+				{
+					Cmd:     TraceCmd{ID: 1, Path: "/usr/bin/nix-instantiate"},
+					Inputs:  []string{testDrv},
+					Outputs: nil,
+				},
+				{
+					Cmd:    TraceCmd{ID: 2, Parent: 1, Path: "/bin/sh"},
+					Inputs: []string{testOut + "/bin/gen"},
+				},
+			},
+			want: nil,
+		},
+		{
+			name: "sources are not outputs",
+			outputs: TraceOuts{
+				{
+					Cmd:    TraceCmd{ID: 1, Path: "/usr/bin/nix-instantiate"},
+					Inputs: []string{testDrv, testSrc + "/default.nix"},
+				},
+			},
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ifdFromTrace(&tt.outputs, "nix-instantiate", readFile)
+			if !equalStrings(got, tt.want) {
+				t.Errorf("ifdFromTrace() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDisabledIFDDerivations(t *testing.T) {
+	output := "error: cannot build '" + testDrv + "' during evaluation because the option 'allow-import-from-derivation' is disabled\n" +
+		"error: cannot build '" + testDrv + "^out' during evaluation because the option 'allow-import-from-derivation' is disabled\n"
+
+	want := []string{testDrv}
+	if got := disabledIFDDerivations([]byte(output)); !equalStrings(got, want) {
+		t.Errorf("disabledIFDDerivations() = %q, want %q", got, want)
+	}
+	if got := disabledIFDDerivations([]byte("error: undefined variable 'foo'")); got != nil {
+		t.Errorf("disabledIFDDerivations() = %q, want nil", got)
+	}
+}
+
+func TestIFDProbeFlag(t *testing.T) {
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{args: nil, want: false},
+		{args: []string{"-" + FLAG_IFD_PROBE}, want: true},
+		{args: []string{"-" + FLAG_IFD_PROBE + "=false"}, want: false},
+	}
+
+	for _, tt := range tests {
+		root := nixconfig.New()
+		var f nixFlags
+		flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+		f.register(flagSet, root)
+		if err := flagSet.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.apply(root); err != nil {
+			t.Fatal(err)
+		}
+		if root.IFDProbe != tt.want {
+			t.Errorf("%q: IFDProbe = %t, want %t", tt.args, root.IFDProbe, tt.want)
+		}
+		if child := root.NewChild(); child.IFDProbe != tt.want {
+			t.Errorf("%q: child IFDProbe = %t, want %t", tt.args, child.IFDProbe, tt.want)
+		}
+	}
+}
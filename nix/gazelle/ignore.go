@@ -0,0 +1,33 @@
+package gazelle
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// parseIgnoreMarkers parses the names of the files marking directories
+// as ignored. An empty value disables markers.
+func parseIgnoreMarkers(value string) ([]string, error) {
+	markers := strings.Fields(value)
+	for _, marker := range markers {
+		if marker == "." || marker == ".." || filepath.Base(marker) != marker {
+			return nil, fmt.Errorf("%w: %q is not a file name", errParse, marker)
+		}
+	}
+
+	return markers, nil
+}
+
+// hasIgnoreMarker tells whether the directory contains one of the
+// markers.
+func hasIgnoreMarker(dir string, markers []string) bool {
+	for _, marker := range markers {
+		if _, err := os.Lstat(filepath.Join(dir, marker)); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,58 @@
+package gazelle
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseIgnoreMarkers(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  []string
+		err   bool
+	}{
+		{name: "markers", value: " .nix-ignore  NOGAZELLE ", want: []string{".nix-ignore", "NOGAZELLE"}},
+		{name: "empty disables", value: "", want: nil},
+		{name: "current directory", value: ".", err: true},
+		{name: "parent directory", value: ".nix-ignore ..", err: true},
+		{name: "path", value: "sub/.nix-ignore", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseIgnoreMarkers(tt.value)
+			if tt.err {
+				if !errors.Is(err, errParse) {
+					t.Fatalf("parseIgnoreMarkers() error = %v, want a parse error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalStrings(got, tt.want) {
+				t.Errorf("parseIgnoreMarkers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasIgnoreMarker(t *testing.T) {
+	dir := writeWorkspace(t, map[string]string{
+		"ignored/.nix-ignore": "",
+		"kept/default.nix":    "{ }",
+	})
+	markers := []string{"NOGAZELLE", ".nix-ignore"}
+
+	if !hasIgnoreMarker(filepath.Join(dir, "ignored"), markers) {
+		t.Error("directory with a marker is not ignored")
+	}
+	if hasIgnoreMarker(filepath.Join(dir, "kept"), markers) {
+		t.Error("directory without a marker is ignored")
+	}
+	if hasIgnoreMarker(filepath.Join(dir, "ignored"), nil) {
+		t.Error("directory is ignored with markers disabled")
+	}
+}
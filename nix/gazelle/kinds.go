@@ -12,17 +12,30 @@ func (*nixLang) Kinds() map[string]rule.KindInfo {
 		EXPORT_RULE: {
 			MatchAny:   false,
 			MatchAttrs: []string{"name"},
+			MergeableAttrs: map[string]bool{
+				"visibility": true,
+			},
 		},
 		MANIFEST_RULE: {
 			MatchAttrs: []string{"name", "nix_file_deps"},
 			MergeableAttrs: map[string]bool{
-				"nix_file_deps": true,
+				"nix_file_deps":      true,
+				"nixopts":            true,
+				"fail_not_supported": true,
+				"quiet":              true,
+				"build_file_content": true,
+				"tags":               true,
 			},
 		},
 		PACKAGE_RULE: {
 			MatchAttrs: []string{"name", "nix_file_deps"},
 			MergeableAttrs: map[string]bool{
-				"nix_file_deps": true,
+				"nix_file_deps":      true,
+				"nixopts":            true,
+				"fail_not_supported": true,
+				"quiet":              true,
+				"build_file_content": true,
+				"tags":               true,
 			},
 		},
 	}
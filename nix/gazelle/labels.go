@@ -0,0 +1,325 @@
+package gazelle
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bazelbuild/bazel-gazelle/pathtools"
+	"github.com/bazelbuild/bazel-gazelle/repo"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+// externalRepository is a Bazel repository, other than the main one,
+// whose files may be read during evaluation.
+type externalRepository struct {
+	name string
+	root string
+}
+
+// labeler translates the paths of traced inputs into Bazel labels.
+type labeler struct {
+	workspaceRoot string
+	// repositories are ordered from the most to the least nested root.
+	repositories []externalRepository
+
+	// outputs caches the outputs declared by the rules of BUILD files,
+	// indexed by package directory, then by output file name.
+	outputs      map[string]map[string]string
+	outputsMutex sync.Mutex
+}
+
+// generatedFileRegex matches files produced by Bazel, capturing their
+// path relative to the output tree, e.g. pkg/out.json for
+// bazel-out/k8-fastbuild/bin/pkg/out.json.
+var generatedFileRegex = regexp.MustCompile(`(?:^|/)bazel-out/[^/]+/(?:bin|genfiles)/(.+)$`)
+
+var (
+	labelers      = make(map[string]*labeler)
+	labelersMutex sync.Mutex
+)
+
+// getLabeler returns the labeler of the workspace. External repositories
+// are discovered once per workspace.
+func getLabeler(workspaceRoot string) *labeler {
+	labelersMutex.Lock()
+	defer labelersMutex.Unlock()
+
+	if l, ok := labelers[workspaceRoot]; ok {
+		return l
+	}
+
+	l := &labeler{
+		workspaceRoot: workspaceRoot,
+		repositories:  discoverExternalRepositories(workspaceRoot),
+		outputs:       make(map[string]map[string]string),
+	}
+	labelers[workspaceRoot] = l
+
+	return l
+}
+
+// discoverExternalRepositories lists the repositories fetched into the
+// output base of the workspace, and the local repositories declared in
+// its WORKSPACE file.
+func discoverExternalRepositories(workspaceRoot string) []externalRepository {
+	var repositories []externalRepository
+
+	if outputBase := findOutputBase(workspaceRoot); outputBase != "" {
+		externalDir := filepath.Join(outputBase, "external")
+		entries, _ := os.ReadDir(externalDir)
+		for _, entry := range entries {
+			if entry.IsDir() {
+				repositories = append(repositories, externalRepository{
+					name: entry.Name(),
+					root: filepath.Join(externalDir, entry.Name()),
+				})
+			}
+		}
+	}
+
+	repositories = append(repositories, localRepositories(workspaceRoot)...)
+
+	sort.SliceStable(repositories, func(i, j int) bool {
+		return len(repositories[i].root) > len(repositories[j].root)
+	})
+
+	return repositories
+}
+
+// findOutputBase resolves the output base of the workspace through the
+// bazel-<workspace> convenience symlink, which points to
+// <output_base>/execroot/<workspace name>.
+func findOutputBase(workspaceRoot string) string {
+	entries, _ := os.ReadDir(workspaceRoot)
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "bazel-") || entry.Type()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		target, err := filepath.EvalSymlinks(filepath.Join(workspaceRoot, entry.Name()))
+		if err != nil || filepath.Base(filepath.Dir(target)) != "execroot" {
+			continue
+		}
+
+		return filepath.Dir(filepath.Dir(target))
+	}
+
+	return ""
+}
+
+func localRepositories(workspaceRoot string) []externalRepository {
+	var repositories []externalRepository
+
+	for _, name := range []string{"WORKSPACE.bazel", "WORKSPACE"} {
+		workspaceFile := filepath.Join(workspaceRoot, name)
+		if !fileExists(workspaceFile) {
+			continue
+		}
+
+		f, err := rule.LoadWorkspaceFile(workspaceFile, "")
+		if err != nil {
+			return nil
+		}
+		rules, _, err := repo.ListRepositories(f)
+		if err != nil {
+			return nil
+		}
+
+		for _, r := range rules {
+			if r.Kind() != "local_repository" && r.Kind() != "new_local_repository" {
+				continue
+			}
+			root := r.AttrString("path")
+			if root == "" {
+				continue
+			}
+			if !filepath.IsAbs(root) {
+				root = filepath.Join(workspaceRoot, root)
+			}
+			if filepath.Clean(root) == filepath.Clean(workspaceRoot) {
+				continue
+			}
+			repositories = append(repositories, externalRepository{
+				name: r.Name(),
+				root: filepath.Clean(root),
+			})
+		}
+
+		return repositories
+	}
+
+	return repositories
+}
+
+// label returns the label of the file, and whether the file belongs to
+// the workspace, or to one of the known external repositories. External
+// repositories are looked up first, as local repositories may be nested
+// in the workspace. buildPackages tells how the packages of workspace
+// files are found, see getBazelPackage.
+func (l *labeler) label(filePath string, buildPackages bool) (string, bool) {
+	if label, ok := l.generatedLabel(filePath); ok {
+		return label, true
+	}
+
+	if label, ok := l.externalLabel(filePath); ok {
+		return label, true
+	}
+
+	if pathtools.HasPrefix(filePath, l.workspaceRoot) {
+		return getBazelTarget(l.workspaceRoot, filePath, buildPackages), true
+	}
+
+	return "", false
+}
+
+// isSource tells if the file is a source file of the workspace, as
+// opposed to a file produced by Bazel, or to a file of an external
+// repository, even one nested in the workspace.
+func (l *labeler) isSource(filePath string) bool {
+	if _, generated := l.generatedRelPath(filePath); generated {
+		return false
+	}
+	if _, external := l.externalLabel(filePath); external {
+		return false
+	}
+
+	return pathtools.HasPrefix(filePath, l.workspaceRoot)
+}
+
+// externalLabel returns the @repo//pkg:file label of a file located in
+// an external repository. The package is the closest directory holding a
+// BUILD file.
+func (l *labeler) externalLabel(filePath string) (string, bool) {
+	for _, r := range l.repositories {
+		if !pathtools.HasPrefix(filePath, r.root) || filePath == r.root {
+			continue
+		}
+
+		pkg := filepath.Dir(filePath)
+		for ; pkg != r.root; pkg = filepath.Dir(pkg) {
+			if fileExists(filepath.Join(pkg, "BUILD.bazel")) || fileExists(filepath.Join(pkg, "BUILD")) {
+				break
+			}
+		}
+
+		return fmt.Sprintf(
+			"@%s//%s:%s",
+			r.name,
+			pathtools.TrimPrefix(pkg, r.root),
+			pathtools.TrimPrefix(filePath, pkg),
+		), true
+	}
+
+	return "", false
+}
+
+// generatedRelPath returns the path of a file produced by Bazel, relative
+// to the output tree, either reached through bazel-out, or through one of
+// the bazel-bin and bazel-genfiles convenience symlinks.
+func (l *labeler) generatedRelPath(filePath string) (string, bool) {
+	if match := generatedFileRegex.FindStringSubmatch(filePath); match != nil {
+		return match[1], true
+	}
+
+	for _, symlink := range []string{"bazel-bin", "bazel-genfiles"} {
+		dir := filepath.Join(l.workspaceRoot, symlink)
+		if pathtools.HasPrefix(filePath, dir) && filePath != dir {
+			return pathtools.TrimPrefix(filePath, dir), true
+		}
+	}
+
+	return "", false
+}
+
+// generatedLabel returns the label of the target generating the file,
+// if the file was produced by Bazel. The generating rule is looked up
+// among the outputs declared in the BUILD file of the package. When it
+// cannot be found, the label of the output file itself is returned.
+func (l *labeler) generatedLabel(filePath string) (string, bool) {
+	relPath, ok := l.generatedRelPath(filePath)
+	if !ok {
+		return "", false
+	}
+
+	repoName, root := "", l.workspaceRoot
+	if parts := strings.SplitN(relPath, "/", 3); len(parts) == 3 && parts[0] == "external" {
+		repoName, relPath = parts[1], parts[2]
+		root = ""
+		for _, r := range l.repositories {
+			if r.name == repoName {
+				root = r.root
+				break
+			}
+		}
+	}
+
+	prefix := "//"
+	if repoName != "" {
+		prefix = "@" + repoName + "//"
+	}
+
+	for pkg := parentPackage(relPath); root != ""; pkg = parentPackage(pkg) {
+		if ruleName, ok := l.outputsOf(root, pkg)[pathtools.TrimPrefix(relPath, pkg)]; ok {
+			return fmt.Sprintf("%s%s:%s", prefix, pkg, ruleName), true
+		}
+		if pkg == "" {
+			break
+		}
+	}
+
+	return fmt.Sprintf("%s%s:%s", prefix, parentPackage(relPath), path.Base(relPath)), true
+}
+
+// parentPackage returns the slash-separated parent directory of rel, or
+// "" for the repository root.
+func parentPackage(rel string) string {
+	if dir := path.Dir(rel); dir != "." {
+		return dir
+	}
+
+	return ""
+}
+
+// outputsOf returns the outputs declared by the rules of the BUILD file
+// of the package, mapped to the names of the rules declaring them.
+func (l *labeler) outputsOf(root string, pkg string) map[string]string {
+	dir := filepath.Join(root, pkg)
+
+	l.outputsMutex.Lock()
+	defer l.outputsMutex.Unlock()
+
+	if outputs, ok := l.outputs[dir]; ok {
+		return outputs
+	}
+
+	outputs := make(map[string]string)
+	for _, name := range []string{"BUILD.bazel", "BUILD"} {
+		buildFile := filepath.Join(dir, name)
+		if !fileExists(buildFile) {
+			continue
+		}
+
+		f, err := rule.LoadFile(buildFile, pkg)
+		if err != nil {
+			break
+		}
+		for _, r := range f.Rules {
+			for _, out := range r.AttrStrings("outs") {
+				outputs[out] = r.Name()
+			}
+			if out := r.AttrString("out"); out != "" {
+				outputs[out] = r.Name()
+			}
+		}
+		break
+	}
+	l.outputs[dir] = outputs
+
+	return outputs
+}
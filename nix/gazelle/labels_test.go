@@ -0,0 +1,57 @@
+package gazelle
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLabelerLabel(t *testing.T) {
+	workspaceRoot := writeWorkspace(t, map[string]string{
+		"WORKSPACE": `
+local_repository(name = "x", path = "third_party/x")
+local_repository(name = "y", path = "third_party/x/vendor/y")
+`,
+		"pkg/default.nix":                         "",
+		"pkg/b.nix":                               "",
+		"pkg/sub/BUILD.bazel":                     "",
+		"pkg/sub/c.nix":                           "",
+		"third_party/x/lib/BUILD.bazel":           "",
+		"third_party/x/lib/a.nix":                 "",
+		"third_party/x/vendor/y/default.nix":      "",
+		"third_party/x/vendor/y/sub/BUILD":        "",
+		"third_party/x/vendor/y/sub/src/data.txt": "",
+	})
+
+	l := getLabeler(workspaceRoot)
+
+	tests := []struct {
+		file          string
+		buildPackages bool
+		want          string
+		source        bool
+	}{
+		{file: "pkg/b.nix", want: "//pkg:b.nix", source: true},
+		{file: "pkg/sub/c.nix", want: "//pkg:sub/c.nix", source: true},
+		{file: "pkg/sub/c.nix", buildPackages: true, want: "//pkg/sub:c.nix", source: true},
+		{file: "third_party/x/lib/a.nix", want: "@x//lib:a.nix"},
+		{file: "third_party/x/vendor/y/default.nix", want: "@y//:default.nix"},
+		{file: "third_party/x/vendor/y/sub/src/data.txt", want: "@y//sub:src/data.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			filePath := filepath.Join(workspaceRoot, tt.file)
+			got, ok := l.label(filePath, tt.buildPackages)
+			if !ok || got != tt.want {
+				t.Errorf("label() = %q, %t, want %q, true", got, ok, tt.want)
+			}
+			if source := l.isSource(filePath); source != tt.source {
+				t.Errorf("isSource() = %t, want %t", source, tt.source)
+			}
+		})
+	}
+
+	if got, ok := l.label("/etc/nix/nix.conf", false); ok {
+		t.Errorf("label() = %q, true, want an unknown file", got)
+	}
+}
@@ -0,0 +1,73 @@
+package gazelle
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+var errMode = errors.New("invalid mode")
+
+// resolveMode returns the mode of a directory: the configured one, or
+// else the one detected from the configuration. Flakes are never
+// detected, and require the flake mode.
+func resolveMode(nixCfg *nixconfig.NixLanguageConfig) (nixconfig.Mode, error) {
+	switch nixCfg.Mode {
+	case nixconfig.MODE_AUTO:
+		switch {
+		case nixCfg.Discovery != nil:
+			return nixconfig.MODE_OVERLAY, nil
+		case nixCfg.NixPrelude != "":
+			return nixconfig.MODE_PRELUDE, nil
+		}
+		return nixconfig.MODE_VANILLA, nil
+	case nixconfig.MODE_PRELUDE:
+		if nixCfg.NixPrelude == "" {
+			return "", fmt.Errorf("%w: %s mode requires %s", errMode, nixCfg.Mode, nixconfig.NIX_PRELUDE)
+		}
+	case nixconfig.MODE_OVERLAY:
+		if nixCfg.Discovery == nil {
+			return "", fmt.Errorf(
+				"%w: %s mode requires %s or %s",
+				errMode,
+				nixCfg.Mode,
+				nixconfig.NIX_OVERLAY,
+				nixconfig.NIX_ATTRSET,
+			)
+		}
+	}
+
+	return nixCfg.Mode, nil
+}
+
+// usesPrelude tells whether default.nix files are evaluated as
+// attributes of the prelude, rather than on their own.
+func usesPrelude(nixCfg *nixconfig.NixLanguageConfig) bool {
+	return nixCfg.NixPrelude != "" &&
+		(nixCfg.Mode == nixconfig.MODE_AUTO || nixCfg.Mode == nixconfig.MODE_PRELUDE)
+}
+
+// usesDiscovery tells whether packages are discovered from the overlay,
+// or attribute set, rather than from default.nix files.
+func usesDiscovery(nixCfg *nixconfig.NixLanguageConfig) bool {
+	return nixCfg.Discovery != nil &&
+		(nixCfg.Mode == nixconfig.MODE_AUTO || nixCfg.Mode == nixconfig.MODE_OVERLAY)
+}
+
+// usesBuildPackages tells whether the packages are defined in directories
+// without default.nix file, which then own their files through their
+// BUILD file.
+func usesBuildPackages(nixCfg *nixconfig.NixLanguageConfig) bool {
+	return usesDiscovery(nixCfg) || nixCfg.Mode == nixconfig.MODE_FLAKE
+}
+
+func hasFile(files []string, name string) bool {
+	for _, f := range files {
+		if f == name {
+			return true
+		}
+	}
+
+	return false
+}
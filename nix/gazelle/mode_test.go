@@ -0,0 +1,126 @@
+package gazelle
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+func TestResolveMode(t *testing.T) {
+	discovery := &nixconfig.Discovery{Kind: nixconfig.DISCOVERY_OVERLAY, File: "overlay.nix"}
+
+	tests := []struct {
+		name      string
+		nixConfig nixconfig.NixLanguageConfig
+		want      nixconfig.Mode
+		err       bool
+	}{
+		{
+			name:      "vanilla",
+			nixConfig: nixconfig.NixLanguageConfig{Mode: nixconfig.MODE_AUTO},
+			want:      nixconfig.MODE_VANILLA,
+		},
+		{
+			name:      "flake is not detected",
+			nixConfig: nixconfig.NixLanguageConfig{Mode: nixconfig.MODE_AUTO},
+			want:      nixconfig.MODE_VANILLA,
+		},
+		{
+			name:      "flake",
+			nixConfig: nixconfig.NixLanguageConfig{Mode: nixconfig.MODE_FLAKE},
+			want:      nixconfig.MODE_FLAKE,
+		},
+		{
+			name:      "prelude",
+			nixConfig: nixconfig.NixLanguageConfig{Mode: nixconfig.MODE_AUTO, NixPrelude: "default.nix"},
+			want:      nixconfig.MODE_PRELUDE,
+		},
+		{
+			name: "overlay",
+			nixConfig: nixconfig.NixLanguageConfig{
+				Mode:       nixconfig.MODE_AUTO,
+				NixPrelude: "default.nix",
+				Discovery:  discovery,
+			},
+			want: nixconfig.MODE_OVERLAY,
+		},
+		{
+			name:      "explicit",
+			nixConfig: nixconfig.NixLanguageConfig{Mode: nixconfig.MODE_VANILLA, Discovery: discovery},
+			want:      nixconfig.MODE_VANILLA,
+		},
+		{
+			name:      "prelude without prelude",
+			nixConfig: nixconfig.NixLanguageConfig{Mode: nixconfig.MODE_PRELUDE},
+			err:       true,
+		},
+		{
+			name:      "overlay without discovery",
+			nixConfig: nixconfig.NixLanguageConfig{Mode: nixconfig.MODE_OVERLAY},
+			err:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveMode(&tt.nixConfig)
+			if tt.err {
+				if !errors.Is(err, errMode) {
+					t.Fatalf("resolveMode() error = %v, want a mode error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveMode() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("resolveMode() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlakeFilesBelongToTheirBuildPackage(t *testing.T) {
+	nixConfig := flakeConfig(&nixconfig.NixLanguageConfig{Mode: nixconfig.MODE_FLAKE})
+	if !usesBuildPackages(nixConfig) {
+		t.Fatal("usesBuildPackages() = false for a flake")
+	}
+	if nixConfig.NixOptions["extra-experimental-features"] != FLAKE_FEATURES {
+		t.Errorf("NixOptions = %v, want the flake features", nixConfig.NixOptions)
+	}
+
+	workspaceRoot := writeWorkspace(t, map[string]string{
+		"WORKSPACE":         "",
+		"tools/BUILD.bazel": "",
+		"tools/flake.nix":   "",
+	})
+	if got := getBazelTarget(workspaceRoot, workspaceRoot+"/tools/flake.nix", usesBuildPackages(nixConfig)); got != "//tools:flake.nix" {
+		t.Errorf("getBazelTarget() = %s, want //tools:flake.nix", got)
+	}
+}
+
+func TestWithoutBuildFiles(t *testing.T) {
+	tests := []struct {
+		rel    string
+		labels []string
+		want   []string
+	}{
+		{
+			rel:    "tools",
+			labels: []string{"//tools:BUILD.bazel", "//tools:flake.nix", "//other:BUILD.bazel"},
+			want:   []string{"//tools:flake.nix", "//other:BUILD.bazel"},
+		},
+		{
+			rel:    "",
+			labels: []string{"//:BUILD", "//:flake.lock", "//:flake.nix"},
+			want:   []string{"//:flake.lock", "//:flake.nix"},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := withoutBuildFiles(tt.labels, tt.rel); !equalStrings(got, tt.want) {
+			t.Errorf("withoutBuildFiles(%q) = %q, want %q", tt.rel, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package gazelle
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+// ROOT_NAME names the package of the workspace root, whose path has no
+// components.
+const ROOT_NAME = "root"
+
+var (
+	// repositoryNameRegex matches valid repository names.
+	repositoryNameRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]*$`)
+	// invalidNameCharRegex matches the characters repository names cannot
+	// contain.
+	invalidNameCharRegex = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+	// nameFragmentRegex matches valid prefixes and separators.
+	nameFragmentRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]*$`)
+)
+
+// sanitizeRepositoryName turns name into a valid repository name, by
+// replacing invalid characters with "_", and making sure it starts with
+// a letter.
+func sanitizeRepositoryName(name string) string {
+	name = invalidNameCharRegex.ReplaceAllString(name, "_")
+	if !repositoryNameRegex.MatchString(name) {
+		name = "nix_" + name
+	}
+
+	return name
+}
+
+// repositoryName returns the name of the repository generated for a
+// package, given the components of its path: the directory path of a
+// default.nix package, or the attribute path of a discovered derivation.
+// An explicit name, given by key in the configuration of the directory,
+// takes precedence.
+func repositoryName(nixCfg *nixconfig.NixLanguageConfig, key string, components []string) string {
+	if name, ok := nixCfg.Names[key]; ok {
+		return name
+	}
+
+	if nixCfg.NameStrip < len(components) {
+		components = components[nixCfg.NameStrip:]
+	} else {
+		components = nil
+	}
+	name := strings.Join(components, nixCfg.NameSeparator)
+	if name == "" {
+		name = ROOT_NAME
+	}
+
+	return sanitizeRepositoryName(nixCfg.NamePrefix + name)
+}
+
+// nixPackageName returns the name of the repository generated for the
+// nix package located in the rel directory.
+func nixPackageName(nixCfg *nixconfig.NixLanguageConfig, rel string) string {
+	var components []string
+	if rel != "" {
+		components = strings.Split(rel, "/")
+	}
+
+	return repositoryName(nixCfg, "", components)
+}
+
+// parseNameFragment parses a prefix or a separator of repository names.
+func parseNameFragment(value string) (string, error) {
+	fragment := strings.TrimSpace(value)
+	if !nameFragmentRegex.MatchString(fragment) {
+		return "", fmt.Errorf("%w: %q may only contain letters, digits, _, - and .", errParse, fragment)
+	}
+
+	return fragment, nil
+}
+
+// parseNameStrip parses the number of leading path components dropped
+// from repository names.
+func parseNameStrip(value string) (int, error) {
+	strip, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || strip < 0 {
+		return 0, fmt.Errorf("%w: expected a non-negative number, got %q", errParse, value)
+	}
+
+	return strip, nil
+}
+
+// parseNixName sets the explicit repository name of the default.nix
+// package of the directory, or, as <attribute path>=<name>, of one of the
+// derivations discovered in the directory.
+func parseNixName(nixConfig *nixconfig.NixLanguageConfig, value string) error {
+	key, name := "", strings.TrimSpace(value)
+	if i := strings.LastIndex(name, "="); i >= 0 {
+		key, name = name[:i], name[i+1:]
+		if !attrPathRegex.MatchString(key) {
+			return fmt.Errorf("%w: invalid attribute path %q", errParse, key)
+		}
+	}
+	if !repositoryNameRegex.MatchString(name) {
+		return fmt.Errorf("%w: %q is not a valid repository name", errParse, name)
+	}
+
+	names := copyStringMap(nixConfig.Names)
+	names[key] = name
+	nixConfig.Names = names
+
+	return nil
+}
+
+var (
+	// claimedNames maps the repository names generated during the run to
+	// the packages they were generated for. Only the visited directories
+	// are covered: collisions with packages outside of them are reported
+	// by reportDuplicateManifests when updating repositories.
+	claimedNames      = make(map[string]string)
+	claimedNamesMutex sync.Mutex
+)
+
+// resetClaimedNames forgets the repository names claimed by a previous
+// run, e.g. when gazelle is run several times in the same process.
+func resetClaimedNames() {
+	claimedNamesMutex.Lock()
+	defer claimedNamesMutex.Unlock()
+
+	claimedNames = make(map[string]string)
+}
+
+// claimRepositoryName records that the repository name is used by the
+// package. The run is aborted when another package already uses it, as
+// one of them would silently replace the other in the WORKSPACE file.
+func claimRepositoryName(logger *zerolog.Logger, name string, pkg string) {
+	claimedNamesMutex.Lock()
+	defer claimedNamesMutex.Unlock()
+
+	if other, ok := claimedNames[name]; ok && other != pkg {
+		logger.Fatal().
+			Str("repository", name).
+			Strs("packages", []string{other, pkg}).
+			Msgf("packages %s and %s map to the same repository name %s, set nix_name in one of them", other, pkg, name)
+	}
+	claimedNames[name] = pkg
+}
+
+// reportDuplicateManifests aborts the run when several manifests, found
+// while collecting repositories, declare the same repository name.
+func reportDuplicateManifests(logger *zerolog.Logger, manifests map[string][]string) {
+	var duplicates []string
+	for name, buildFiles := range manifests {
+		if len(buildFiles) > 1 {
+			duplicates = append(duplicates, name)
+		}
+	}
+	if len(duplicates) == 0 {
+		return
+	}
+	sort.Strings(duplicates)
+
+	for _, name := range duplicates {
+		logger.Error().
+			Str("repository", name).
+			Strs("build_files", manifests[name]).
+			Msgf("repository %s is declared by several manifests", name)
+	}
+	logger.Fatal().
+		Strs("repositories", duplicates).
+		Msg("repository names must be unique, set nix_name in the conflicting packages")
+}
@@ -0,0 +1,190 @@
+package gazelle
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+func TestSanitizeRepositoryName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "folks.cowsay", want: "folks.cowsay"},
+		{name: "my pkg+extra", want: "my_pkg_extra"},
+		{name: "2048", want: "nix_2048"},
+		{name: "_private", want: "nix__private"},
+		{name: "", want: "nix_"},
+	}
+
+	for _, tt := range tests {
+		if got := sanitizeRepositoryName(tt.name); got != tt.want {
+			t.Errorf("sanitizeRepositoryName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRepositoryName(t *testing.T) {
+	tests := []struct {
+		name       string
+		nixConfig  nixconfig.NixLanguageConfig
+		key        string
+		components []string
+		want       string
+	}{
+		{
+			name:       "default",
+			nixConfig:  nixconfig.NixLanguageConfig{NameSeparator: "."},
+			components: []string{"folks", "cool-kid"},
+			want:       "folks.cool-kid",
+		},
+		{
+			name:      "root",
+			nixConfig: nixconfig.NixLanguageConfig{NameSeparator: "."},
+			want:      ROOT_NAME,
+		},
+		{
+			name:       "prefix and separator",
+			nixConfig:  nixconfig.NixLanguageConfig{NamePrefix: "nix-", NameSeparator: "_"},
+			components: []string{"folks", "cool-kid"},
+			want:       "nix-folks_cool-kid",
+		},
+		{
+			name:       "strip",
+			nixConfig:  nixconfig.NixLanguageConfig{NameSeparator: ".", NameStrip: 1},
+			components: []string{"folks", "cool-kid"},
+			want:       "cool-kid",
+		},
+		{
+			name:       "strip everything",
+			nixConfig:  nixconfig.NixLanguageConfig{NameSeparator: ".", NameStrip: 3},
+			components: []string{"folks", "cool-kid"},
+			want:       ROOT_NAME,
+		},
+		{
+			name:       "sanitized",
+			nixConfig:  nixconfig.NixLanguageConfig{NameSeparator: "."},
+			components: []string{"3d", "tools+extra"},
+			want:       "nix_3d.tools_extra",
+		},
+		{
+			name: "explicit name",
+			nixConfig: nixconfig.NixLanguageConfig{
+				NameSeparator: ".",
+				Names:         map[string]string{"": "cowsay", "tools.hello": "greeter"},
+			},
+			components: []string{"folks", "cowsay"},
+			want:       "cowsay",
+		},
+		{
+			name: "explicit name of a discovered derivation",
+			nixConfig: nixconfig.NixLanguageConfig{
+				NameSeparator: ".",
+				Names:         map[string]string{"": "cowsay", "tools.hello": "greeter"},
+			},
+			key:        "tools.hello",
+			components: []string{"tools", "hello"},
+			want:       "greeter",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := repositoryName(&tt.nixConfig, tt.key, tt.components); got != tt.want {
+				t.Errorf("repositoryName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNixPackageName(t *testing.T) {
+	nixConfig := &nixconfig.NixLanguageConfig{NameSeparator: "."}
+	if got := nixPackageName(nixConfig, "folks/cowsay"); got != "folks.cowsay" {
+		t.Errorf("nixPackageName(folks/cowsay) = %q, want folks.cowsay", got)
+	}
+	if got := nixPackageName(nixConfig, ""); got != ROOT_NAME {
+		t.Errorf("nixPackageName(\"\") = %q, want %s", got, ROOT_NAME)
+	}
+}
+
+func TestParseNixName(t *testing.T) {
+	tests := []struct {
+		value string
+		key   string
+		name  string
+		err   bool
+	}{
+		{value: "cowsay", key: "", name: "cowsay"},
+		{value: "  cowsay  ", key: "", name: "cowsay"},
+		{value: "tools.hello=greeter", key: "tools.hello", name: "greeter"},
+		{value: "tools..hello=greeter", err: true},
+		{value: "tools.hello=", err: true},
+		{value: "my name", err: true},
+		{value: "2048", err: true},
+	}
+
+	for _, tt := range tests {
+		inherited := map[string]string{"other": "kept"}
+		nixConfig := &nixconfig.NixLanguageConfig{Names: inherited}
+		err := parseNixName(nixConfig, tt.value)
+		if tt.err {
+			if !errors.Is(err, errParse) {
+				t.Errorf("parseNixName(%q) error = %v, want a parse error", tt.value, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseNixName(%q) error = %v", tt.value, err)
+			continue
+		}
+		if got := nixConfig.Names[tt.key]; got != tt.name {
+			t.Errorf("parseNixName(%q) names[%q] = %q, want %q", tt.value, tt.key, got, tt.name)
+		}
+		if nixConfig.Names["other"] != "kept" || len(inherited) != 1 {
+			t.Errorf("parseNixName(%q) names = %v, inherited = %v", tt.value, nixConfig.Names, inherited)
+		}
+	}
+}
+
+func TestParseNameFragmentAndStrip(t *testing.T) {
+	if got, err := parseNameFragment(" nix- "); err != nil || got != "nix-" {
+		t.Errorf("parseNameFragment(\" nix- \") = %q, %v", got, err)
+	}
+	if _, err := parseNameFragment("a/b"); !errors.Is(err, errParse) {
+		t.Errorf("parseNameFragment(a/b) error = %v, want a parse error", err)
+	}
+	if got, err := parseNameStrip(" 2 "); err != nil || got != 2 {
+		t.Errorf("parseNameStrip(\" 2 \") = %d, %v", got, err)
+	}
+	for _, value := range []string{"-1", "two", ""} {
+		if _, err := parseNameStrip(value); !errors.Is(err, errParse) {
+			t.Errorf("parseNameStrip(%q) error = %v, want a parse error", value, err)
+		}
+	}
+}
+
+func TestResetClaimedNames(t *testing.T) {
+	logger := zerolog.Nop()
+	resetClaimedNames()
+	defer resetClaimedNames()
+
+	claimRepositoryName(&logger, "folks.cowsay", "//folks/cowsay")
+	claimRepositoryName(&logger, "folks.cowsay", "//folks/cowsay")
+	if got := claimedNames["folks.cowsay"]; got != "//folks/cowsay" {
+		t.Fatalf("claimedNames[folks.cowsay] = %q, want //folks/cowsay", got)
+	}
+
+	resetClaimedNames()
+	if len(claimedNames) != 0 {
+		t.Fatalf("claimedNames = %v after reset, want none", claimedNames)
+	}
+
+	// Would abort the run, had the previous claim been kept.
+	claimRepositoryName(&logger, "folks.cowsay", "//other/cowsay")
+	if got := claimedNames["folks.cowsay"]; got != "//other/cowsay" {
+		t.Errorf("claimedNames[folks.cowsay] = %q, want //other/cowsay", got)
+	}
+}
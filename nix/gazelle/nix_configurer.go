@@ -4,9 +4,16 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/label"
 	"github.com/bazelbuild/bazel-gazelle/rule"
 	"github.com/lainio/err2"
 	"github.com/lainio/err2/try"
@@ -20,10 +27,14 @@ var (
 	_         config.Configurer = &NixConfigurer{}
 	errAssert                   = errors.New("assertion failed")
 	errParse                    = errors.New("directive parsing failed")
+
+	// attrPathRegex matches dot separated attribute names, e.g. pkgs.internal
+	attrPathRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_'-]*(\.[A-Za-z_][A-Za-z0-9_'-]*)*$`)
 )
 
 type NixConfigurer struct {
 	logger *zerolog.Logger
+	flags  nixFlags
 }
 
 func NewNixConfigurer() *NixConfigurer {
@@ -36,18 +47,21 @@ func NewNixConfigurer() *NixConfigurer {
 // extension. This method is called once with the root configuration
 // when Gazelle starts. RegisterFlags may set an initial values in
 // Config.Exts. When flags are set, they should modify these values.
-func (nlc NixConfigurer) RegisterFlags(
+func (nlc *NixConfigurer) RegisterFlags(
 	flagSet *flag.FlagSet,
 	cmd string,
 	config *config.Config,
 ) {
+	nlc.flags.register(flagSet, rootNixConfig(config))
 }
 
+// CheckFlags validates the values of the command-line flags, and sets
+// them in the root configuration, where directives may override them.
 func (nlc *NixConfigurer) CheckFlags(
 	flagSet *flag.FlagSet,
 	config *config.Config,
 ) error {
-	return nil
+	return nlc.flags.apply(rootNixConfig(config))
 }
 
 // KnownDirectives returns a list of directive keys that this
@@ -57,6 +71,38 @@ func (nlc *NixConfigurer) KnownDirectives() []string {
 	return []string{
 		nixconfig.NIX_PRELUDE,
 		nixconfig.NIX_REPOSITORIES,
+		nixconfig.NIX_REPOSITORIES_ADD,
+		nixconfig.NIX_REPOSITORIES_REMOVE,
+		nixconfig.NIX_REPOSITORIES_RESET,
+		nixconfig.NIX_TRACE_ALLOW,
+		nixconfig.NIX_TRACE_DENY,
+		nixconfig.NIX_WRITE_POLICY,
+		nixconfig.NIX_SENSITIVE_PATHS,
+		nixconfig.NIX_READONLY_WORKSPACE,
+		nixconfig.NIX_EXTERNAL_INPUTS_POLICY,
+		nixconfig.NIX_EXTERNAL_INPUTS_ALLOW,
+		nixconfig.NIX_RESTRICT_EVAL,
+		nixconfig.NIX_ALLOWED_URIS,
+		nixconfig.NIX_ENV_ALLOW,
+		nixconfig.NIX_IFD_POLICY,
+		nixconfig.NIX_ATTRIBUTE_DISCOVERY,
+		nixconfig.NIX_OVERLAY,
+		nixconfig.NIX_ATTRSET,
+		nixconfig.NIX_TRACER,
+		nixconfig.NIX_EVALUATOR,
+		nixconfig.NIX_TIMEOUT,
+		nixconfig.NIX_KEEP_GOING,
+		nixconfig.NIX_ARG,
+		nixconfig.NIX_ARGSTR,
+		nixconfig.NIX_OPTION,
+		nixconfig.NIX_PACKAGE_ATTR,
+		nixconfig.NIX_NAME_PREFIX,
+		nixconfig.NIX_NAME_SEPARATOR,
+		nixconfig.NIX_NAME_STRIP,
+		nixconfig.NIX_NAME,
+		nixconfig.NIX_ENABLED,
+		nixconfig.NIX_MODE,
+		nixconfig.NIX_IGNORE_MARKERS,
 	}
 }
 
@@ -79,23 +125,29 @@ func (nlc *NixConfigurer) Configure(config *config.Config, relative string, buil
 		Str("path", relative).
 		Msg("")
 
+	if relative == "" {
+		resetClaimedNames()
+		resetExports()
+	}
+
 	nlc.logger.Trace().Msg("creating config")
 
 	cfg := createNixConfig(config, relative)
+	var index int
 	var directive rule.Directive
 	var dk, dv string
 
 	defer err2.Catch(func(err error) {
 		nlc.logger.
 			Fatal().
-			Err(err).
-			Str("value", dk).
-			Str("directive", dv).
+			Err(newDirectiveError(buildFile, index, err)).
+			Str("directive", dk).
+			Str("value", dv).
 			Msgf("Cannot parse %s directive, invalid value %s", dk, dv)
 	})
 
 	if buildFile != nil {
-		for _, directive = range buildFile.Directives {
+		for index, directive = range buildFile.Directives {
 			dk, dv = directive.Key, directive.Value
 			nlc.logger.Trace().
 				Str("directive", dk).
@@ -103,50 +155,527 @@ func (nlc *NixConfigurer) Configure(config *config.Config, relative string, buil
 				Msgf("setting config %s, using value %s", dk, dv)
 			switch directive.Key {
 			case nixconfig.NIX_PRELUDE:
-				try.To(parseNixPrelude(cfg, dv))
+				try.To(parseNixPrelude(cfg, config.RepoRoot, relative, dv))
 			case nixconfig.NIX_REPOSITORIES:
 				try.To(parseNixRepositories(cfg, dv))
+			case nixconfig.NIX_REPOSITORIES_ADD:
+				try.To(parseNixRepositoriesAdd(cfg, dv))
+			case nixconfig.NIX_REPOSITORIES_REMOVE:
+				try.To(parseNixRepositoriesRemove(cfg, dv))
+			case nixconfig.NIX_REPOSITORIES_RESET:
+				try.To(parseNixRepositoriesReset(cfg, dv))
+			case nixconfig.NIX_TRACE_ALLOW:
+				cfg.TraceAllow = try.To1(parsePatterns(dv))
+			case nixconfig.NIX_TRACE_DENY:
+				cfg.TraceDeny = try.To1(parsePatterns(dv))
+			case nixconfig.NIX_WRITE_POLICY:
+				cfg.WritePolicy = try.To1(nixconfig.ParsePolicy(dv))
+			case nixconfig.NIX_SENSITIVE_PATHS:
+				cfg.SensitivePaths = strings.Fields(dv)
+			case nixconfig.NIX_READONLY_WORKSPACE:
+				cfg.ReadOnlyWorkspace = try.To1(strconv.ParseBool(strings.TrimSpace(dv)))
+			case nixconfig.NIX_EXTERNAL_INPUTS_POLICY:
+				try.To(parseExternalInputsPolicy(cfg, dv))
+			case nixconfig.NIX_EXTERNAL_INPUTS_ALLOW:
+				cfg.ExternalInputAllow = try.To1(parsePatterns(dv))
+			case nixconfig.NIX_RESTRICT_EVAL:
+				cfg.RestrictEval = try.To1(strconv.ParseBool(strings.TrimSpace(dv)))
+			case nixconfig.NIX_ALLOWED_URIS:
+				cfg.AllowedURIs = strings.Fields(dv)
+			case nixconfig.NIX_ENV_ALLOW:
+				cfg.EnvAllow = strings.Fields(dv)
+			case nixconfig.NIX_IFD_POLICY:
+				cfg.IFDPolicy = try.To1(nixconfig.ParsePolicy(dv))
+			case nixconfig.NIX_ATTRIBUTE_DISCOVERY:
+				cfg.AttributeDiscovery = try.To1(parseAttributeDiscovery(dv))
+			case nixconfig.NIX_OVERLAY:
+				try.To(parseNixDiscovery(cfg, nixconfig.DISCOVERY_OVERLAY, config.RepoRoot, relative, dv))
+			case nixconfig.NIX_ATTRSET:
+				try.To(parseNixDiscovery(cfg, nixconfig.DISCOVERY_ATTRSET, config.RepoRoot, relative, dv))
+			case nixconfig.NIX_TRACER:
+				cfg.Tracer = try.To1(nixconfig.ParseTracer(dv))
+			case nixconfig.NIX_EVALUATOR:
+				try.To(parseEvaluator(cfg, dv))
+			case nixconfig.NIX_TIMEOUT:
+				cfg.Timeout = try.To1(parseTimeout(dv))
+			case nixconfig.NIX_KEEP_GOING:
+				cfg.KeepGoing = try.To1(strconv.ParseBool(strings.TrimSpace(dv)))
+			case nixconfig.NIX_ARG, nixconfig.NIX_ARGSTR:
+				try.To(parseNixArg(cfg, dk, dv))
+			case nixconfig.NIX_OPTION:
+				try.To(parseNixOption(cfg, dv))
+			case nixconfig.NIX_PACKAGE_ATTR:
+				try.To(parseNixPackageAttr(cfg, dv))
+			case nixconfig.NIX_NAME_PREFIX:
+				cfg.NamePrefix = try.To1(parseNameFragment(dv))
+			case nixconfig.NIX_NAME_SEPARATOR:
+				cfg.NameSeparator = try.To1(parseNameFragment(dv))
+			case nixconfig.NIX_NAME_STRIP:
+				cfg.NameStrip = try.To1(parseNameStrip(dv))
+			case nixconfig.NIX_NAME:
+				try.To(parseNixName(cfg, dv))
+			case nixconfig.NIX_ENABLED:
+				cfg.Enabled = try.To1(strconv.ParseBool(strings.TrimSpace(dv)))
+			case nixconfig.NIX_MODE:
+				cfg.Mode = try.To1(nixconfig.ParseMode(dv))
+			case nixconfig.NIX_IGNORE_MARKERS:
+				cfg.IgnoreMarkers = try.To1(parseIgnoreMarkers(dv))
 			}
 		}
 	}
+
+	if !cfg.Ignored && hasIgnoreMarker(filepath.Join(config.RepoRoot, relative), cfg.IgnoreMarkers) {
+		nlc.logger.Debug().
+			Str("path", relative).
+			Msg("directory is marked as ignored")
+		cfg.Ignored = true
+	}
 }
 
-func parseNixPrelude(nixConfig *nixconfig.NixLanguageConfig, value string) (err error) {
-	//TODO implmement parsing
-	nixConfig.NixPrelude = value
+// resolveFileArgument returns the workspace relative path of a file
+// given as a label, or as a path relative to the directory declaring the
+// directive, checking that the file exists, along with its label. A label
+// keeps the package of the directive, while the label of a path assumes
+// its directory is a Bazel package.
+func resolveFileArgument(repoRoot string, relative string, value string) (string, string, error) {
+	file := path.Join(relative, value)
+	var fileLabelString string
+	if isLabel(value) {
+		parsed, err := label.Parse(value)
+		if err != nil {
+			return "", "", fmt.Errorf("%w: invalid label %q: %v", errParse, value, err)
+		}
+		if parsed.Repo != "" {
+			return "", "", fmt.Errorf("%w: %q must belong to the main repository", errParse, value)
+		}
+		if parsed.Relative {
+			parsed.Pkg = relative
+			parsed.Relative = false
+		}
+		file = path.Join(parsed.Pkg, parsed.Name)
+		fileLabelString = parsed.String()
+	}
+
+	if info, err := os.Stat(filepath.Join(repoRoot, file)); err != nil || info.IsDir() {
+		return "", "", fmt.Errorf("%w: %q is not a file", errParse, file)
+	}
+	if fileLabelString == "" {
+		fileLabelString = fileLabel(file)
+	}
+
+	return file, fileLabelString, nil
+}
+
+// parseNixDiscovery sets the overlay, or the attribute set, evaluated to
+// discover the derivations of the subtree. The file is followed by an
+// optional argument: the search path entry of the package set the
+// overlay is applied to, or the attribute path of the attribute set. An
+// empty value disables discovery.
+func parseNixDiscovery(
+	nixConfig *nixconfig.NixLanguageConfig,
+	kind nixconfig.DiscoveryKind,
+	repoRoot string,
+	relative string,
+	value string,
+) error {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		nixConfig.Discovery = nil
+		return nil
+	}
+	if len(fields) > 2 {
+		return fmt.Errorf("%w: expected a file and an optional argument", errParse)
+	}
+
+	file, discoveryLabel, err := resolveFileArgument(repoRoot, relative, fields[0])
+	if err != nil {
+		return err
+	}
+
+	discovery := &nixconfig.Discovery{Kind: kind, File: file, Label: discoveryLabel}
+	if kind == nixconfig.DISCOVERY_OVERLAY {
+		discovery.Arg = "nixpkgs"
+	}
+	if len(fields) == 2 {
+		if !attrPathRegex.MatchString(fields[1]) {
+			return fmt.Errorf("%w: invalid argument %q", errParse, fields[1])
+		}
+		discovery.Arg = fields[1]
+	}
+
+	nixConfig.Discovery = discovery
 	return nil
 }
 
-func parseNixRepositories(nixConfig *nixconfig.NixLanguageConfig, value string) (err error) {
-	const parts = 3
+// parseNixPrelude sets the prelude of the subtree, given as a label, or
+// as a path relative to the directory declaring it, optionally followed
+// by the attribute path packages are rooted under, e.g.
+// "//:default.nix pkgs.internal". Attribute paths are computed relative
+// to the declaring directory. An empty value disables the prelude.
+func parseNixPrelude(
+	nixConfig *nixconfig.NixLanguageConfig,
+	repoRoot string,
+	relative string,
+	value string,
+) (err error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		nixConfig.NixPrelude = ""
+		nixConfig.NixPreludeLabel = ""
+		nixConfig.NixPreludeRoot = ""
+		nixConfig.NixPreludeAttrPrefix = ""
+		return nil
+	}
+	if len(fields) > 2 {
+		return fmt.Errorf("%w: expected a prelude file and an optional attribute path", errParse)
+	}
 
-	triples := strings.Split(value, " ")
-	labelChannelPathTriple := make([]string, 0, len(triples)*parts)
+	prelude, preludeLabel, err := resolveFileArgument(repoRoot, relative, fields[0])
+	if err != nil {
+		return err
+	}
 
-	for _, key := range triples {
-		labelChannelPathTriple = append(labelChannelPathTriple, strings.Split(key, "=")...)
+	var attrPrefix string
+	if len(fields) == 2 {
+		attrPrefix = fields[1]
+		if !attrPathRegex.MatchString(attrPrefix) {
+			return fmt.Errorf("%w: invalid prelude attribute path %q", errParse, attrPrefix)
+		}
 	}
 
-	if len(labelChannelPathTriple)%3 != 0 {
-		return errParse
+	nixConfig.NixPrelude = prelude
+	nixConfig.NixPreludeLabel = preludeLabel
+	nixConfig.NixPreludeRoot = relative
+	nixConfig.NixPreludeAttrPrefix = attrPrefix
+	return nil
+}
+
+// parseNixRepositories replaces the repositories of the subtree with the
+// ones of the value.
+func parseNixRepositories(nixConfig *nixconfig.NixLanguageConfig, value string) error {
+	repositories, searchPath, err := parseRepositoryEntries(value)
+	if err != nil {
+		return err
 	}
 
-	repositories := make(map[string]string)
-	paths := make([]string, 0)
-	for i := 0; i < len(labelChannelPathTriple); i += 3 {
-		repositories[labelChannelPathTriple[i]] = labelChannelPathTriple[i+1]
-		paths = append(
-			paths,
-			fmt.Sprintf(
-				"%s=${BUILD_WORKSPACE_DIRECTORY}/%s",
-				labelChannelPathTriple[i],
-				labelChannelPathTriple[i+2],
-			),
-		)
+	nixConfig.NixRepositories = repositories
+	nixConfig.NixSearchPath = searchPath
+
+	return nil
+}
+
+// parseNixRepositoriesAdd adds the repositories of the value to the
+// inherited ones, replacing those with the same names. The inherited
+// maps are copied, so that the parent configuration is left untouched.
+func parseNixRepositoriesAdd(nixConfig *nixconfig.NixLanguageConfig, value string) error {
+	added, addedSearchPath, err := parseRepositoryEntries(value)
+	if err != nil {
+		return err
+	}
+
+	repositories := copyStringMap(nixConfig.NixRepositories)
+	searchPath := copyStringMap(nixConfig.NixSearchPath)
+	for _, names := range []map[string]string{added, addedSearchPath} {
+		for name := range names {
+			delete(repositories, name)
+			delete(searchPath, name)
+		}
+	}
+	for name, repository := range added {
+		repositories[name] = repository
 	}
+	for name, entryPath := range addedSearchPath {
+		searchPath[name] = entryPath
+	}
+
 	nixConfig.NixRepositories = repositories
-	nixConfig.NixPath = strings.Join(paths, ":")
+	nixConfig.NixSearchPath = searchPath
+
+	return nil
+}
+
+// parseNixRepositoriesRemove removes the repositories, and search path
+// entries, of the whitespace separated names from the inherited ones.
+func parseNixRepositoriesRemove(nixConfig *nixconfig.NixLanguageConfig, value string) error {
+	names := strings.Fields(value)
+	if len(names) == 0 {
+		return fmt.Errorf("%w: expected the names of the repositories to remove", errParse)
+	}
+
+	repositories := copyStringMap(nixConfig.NixRepositories)
+	searchPath := copyStringMap(nixConfig.NixSearchPath)
+	for _, name := range names {
+		_, isRepository := repositories[name]
+		_, isSearchPath := searchPath[name]
+		if !isRepository && !isSearchPath {
+			return fmt.Errorf("%w: %q: no such repository", errParse, name)
+		}
+		delete(repositories, name)
+		delete(searchPath, name)
+	}
+
+	nixConfig.NixRepositories = repositories
+	nixConfig.NixSearchPath = searchPath
+
+	return nil
+}
+
+// parseNixRepositoriesReset clears the inherited repositories.
+func parseNixRepositoriesReset(nixConfig *nixconfig.NixLanguageConfig, value string) error {
+	if strings.TrimSpace(value) != "" {
+		return fmt.Errorf("%w: %q: expected no value", errParse, value)
+	}
+
+	nixConfig.NixRepositories = make(map[string]string)
+	nixConfig.NixSearchPath = make(map[string]string)
+
+	return nil
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	copied := make(map[string]string, len(m))
+	for k, v := range m {
+		copied[k] = v
+	}
+
+	return copied
+}
+
+// parseRepositoryEntries parses a whitespace separated list of
+// repositories, each given as one of:
+//
+//	<name>=<label>=<path>  a search path entry, and the repository providing it
+//	<name>=<label>         a repository, without search path entry
+//	<name>=<path>          a search path entry, without repository
+//
+// where labels start with "@", "//" or ":", and paths are relative to the
+// workspace root. Any part may be quoted, to contain whitespace or "=".
+// It returns the repositories, and the search path entries, by name.
+func parseRepositoryEntries(value string) (_, _ map[string]string, err error) {
+	tokens, err := tokenizeDirective(value)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	repositories := make(map[string]string)
+	searchPath := make(map[string]string)
+	seen := make(map[string]bool)
+	for _, token := range tokens {
+		invalid := func(reason string, args ...interface{}) error {
+			return fmt.Errorf("%w: %q: %s", errParse, token.text, fmt.Sprintf(reason, args...))
+		}
+
+		if len(token.fields) < 2 || len(token.fields) > 3 {
+			return nil, nil, invalid("expected <name>=<label>=<path>, <name>=<label> or <name>=<path>")
+		}
+
+		name := token.fields[0]
+		if name == "" {
+			return nil, nil, invalid("missing name")
+		}
+		if seen[name] {
+			return nil, nil, invalid("%s is declared more than once", name)
+		}
+		seen[name] = true
+
+		var repository, entryPath string
+		if len(token.fields) == 3 {
+			repository, entryPath = token.fields[1], token.fields[2]
+			if repository == "" {
+				return nil, nil, invalid("missing label")
+			}
+			if entryPath == "" {
+				return nil, nil, invalid("missing path")
+			}
+		} else if isLabel(token.fields[1]) {
+			repository = token.fields[1]
+		} else {
+			entryPath = token.fields[1]
+			if entryPath == "" {
+				return nil, nil, invalid("missing label or path")
+			}
+		}
+
+		if repository != "" {
+			if _, err := label.Parse(repository); err != nil {
+				return nil, nil, invalid("invalid label %q: %v", repository, err)
+			}
+			repositories[name] = repository
+		}
+		if entryPath != "" {
+			if clean := path.Clean(entryPath); path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+				return nil, nil, invalid("path %q must be relative to the workspace root", entryPath)
+			}
+			searchPath[name] = path.Clean(entryPath)
+		}
+	}
+
+	return repositories, searchPath, nil
+}
+
+// isLabel tells if the value is written as a label, rather than as a
+// path.
+func isLabel(value string) bool {
+	return strings.HasPrefix(value, "@") || strings.HasPrefix(value, "//") || strings.HasPrefix(value, ":")
+}
+
+// parseEvaluator parses the evaluator binary, given as a label, e.g. the
+// binary of a nixpkgs toolchain, as an absolute path, or as a name looked
+// up in PATH, optionally followed by its command line interface.
+func parseEvaluator(nixConfig *nixconfig.NixLanguageConfig, value string) error {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 2 {
+		return fmt.Errorf("%w: expected an evaluator binary and an optional interface", errParse)
+	}
+
+	if strings.HasPrefix(fields[0], "@") || strings.HasPrefix(fields[0], "//") {
+		if _, err := label.Parse(fields[0]); err != nil {
+			return fmt.Errorf("%w: invalid label %q: %v", errParse, fields[0], err)
+		}
+	}
+
+	cli := nixconfig.CLI_AUTO
+	if len(fields) == 2 {
+		var err error
+		if cli, err = nixconfig.ParseEvaluatorCLI(fields[1]); err != nil {
+			return err
+		}
+	}
+
+	nixConfig.Evaluator = fields[0]
+	nixConfig.EvaluatorCLI = cli
+	return nil
+}
+
+// splitNameValue splits a directive value into a name, and the rest of
+// the value, which may contain whitespace.
+func splitNameValue(value string) (string, string) {
+	value = strings.TrimSpace(value)
+	i := strings.IndexAny(value, " \t")
+	if i < 0 {
+		return value, ""
+	}
+
+	return value[:i], strings.TrimSpace(value[i:])
+}
+
+// parseNixArg sets the argument functions are called with, given as a
+// name followed by a nix expression for nix_arg, or by a string for
+// nix_argstr. A name alone removes the inherited argument.
+func parseNixArg(nixConfig *nixconfig.NixLanguageConfig, key string, value string) error {
+	name, argValue := splitNameValue(value)
+	if !identifierRegex.MatchString(name) {
+		return fmt.Errorf("%w: invalid argument name %q", errParse, name)
+	}
+
+	args := copyStringMap(nixConfig.NixArgs)
+	argStrs := copyStringMap(nixConfig.NixArgStrs)
+	delete(args, name)
+	delete(argStrs, name)
+	if argValue != "" {
+		if key == nixconfig.NIX_ARG {
+			args[name] = argValue
+		} else {
+			argStrs[name] = argValue
+		}
+	}
+
+	nixConfig.NixArgs = args
+	nixConfig.NixArgStrs = argStrs
+	return nil
+}
+
+// parseNixOption sets a nix option, given as a name followed by its
+// value. A name alone removes the inherited option. Options governed by
+// other directives are rejected.
+func parseNixOption(nixConfig *nixconfig.NixLanguageConfig, value string) error {
+	name, optionValue := splitNameValue(value)
+	if !optionNameRegex.MatchString(name) {
+		return fmt.Errorf("%w: invalid option name %q", errParse, name)
+	}
+	if directive, reserved := reservedOptions[name]; reserved {
+		return fmt.Errorf("%w: option %q is set with the %s directive", errParse, name, directive)
+	}
+
+	options := copyStringMap(nixConfig.NixOptions)
+	delete(options, name)
+	if optionValue != "" {
+		options[name] = optionValue
+	}
+
+	nixConfig.NixOptions = options
+	return nil
+}
+
+// parseTimeout parses the duration of a single evaluation, e.g. "90s",
+// where "0" disables the timeout.
+func parseTimeout(value string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("%w: invalid timeout %q", errParse, value)
+	}
+
+	return timeout, nil
+}
+
+// parsePatterns parses a space separated list of glob patterns,
+// such as traced process names. An empty value clears the list.
+func parsePatterns(value string) ([]string, error) {
+	patterns := strings.Fields(value)
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, errParse
+		}
+	}
+
+	return patterns, nil
+}
+
+// parseAttributeDiscovery parses a space separated list of attribute
+// paths, where "." stands for the whole prelude. An empty value disables
+// attribute discovery.
+func parseAttributeDiscovery(value string) ([]string, error) {
+	var roots []string
+	for _, root := range strings.Fields(value) {
+		if root == "." {
+			root = ""
+		} else if !attrPathRegex.MatchString(root) {
+			return nil, fmt.Errorf("%w: invalid attribute path %q", errParse, root)
+		}
+		roots = append(roots, root)
+	}
+
+	return roots, nil
+}
+
+// parseExternalInputsPolicy parses a space separated list of
+// <class>=<policy> pairs. Classes which are not mentioned keep the
+// inherited policy.
+func parseExternalInputsPolicy(nixConfig *nixconfig.NixLanguageConfig, value string) error {
+	policies := make(map[nixconfig.InputClass]nixconfig.Policy, len(nixconfig.InputClasses))
+	for class, policy := range nixConfig.ExternalInputPolicies {
+		policies[class] = policy
+	}
+
+	for _, pair := range strings.Fields(value) {
+		classAndPolicy := strings.SplitN(pair, "=", 2)
+		if len(classAndPolicy) != 2 {
+			return errParse
+		}
+
+		class := nixconfig.InputClass(classAndPolicy[0])
+		if _, known := policies[class]; !known {
+			return errParse
+		}
+
+		policy, err := nixconfig.ParsePolicy(classAndPolicy[1])
+		if err != nil {
+			return err
+		}
+		policies[class] = policy
+	}
 
+	nixConfig.ExternalInputPolicies = policies
 	return nil
 }
 
@@ -0,0 +1,367 @@
+package gazelle
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+func TestParseRepositoryEntries(t *testing.T) {
+	tests := []struct {
+		name         string
+		value        string
+		repositories map[string]string
+		searchPath   map[string]string
+		err          bool
+	}{
+		{
+			name:         "label and path",
+			value:        "nixpkgs=@nixpkgs//:nixpkgs=nix/nixpkgs.nix",
+			repositories: map[string]string{"nixpkgs": "@nixpkgs//:nixpkgs"},
+			searchPath:   map[string]string{"nixpkgs": "nix/nixpkgs.nix"},
+		},
+		{
+			name:         "label only",
+			value:        "nixpkgs=@nixpkgs",
+			repositories: map[string]string{"nixpkgs": "@nixpkgs"},
+			searchPath:   map[string]string{},
+		},
+		{
+			name:         "local label only",
+			value:        "lib=//nix:lib lib2=:lib2",
+			repositories: map[string]string{"lib": "//nix:lib", "lib2": ":lib2"},
+			searchPath:   map[string]string{},
+		},
+		{
+			name:         "path only",
+			value:        "lib=nix/lib/./",
+			repositories: map[string]string{},
+			searchPath:   map[string]string{"lib": "nix/lib"},
+		},
+		{
+			name:         "repeated spaces",
+			value:        "  a=@a   b=nix/b  ",
+			repositories: map[string]string{"a": "@a"},
+			searchPath:   map[string]string{"b": "nix/b"},
+		},
+		{
+			name:         "quoted path with = and whitespace",
+			value:        `a=@a="nix/x=y z.nix"`,
+			repositories: map[string]string{"a": "@a"},
+			searchPath:   map[string]string{"a": "nix/x=y z.nix"},
+		},
+		{
+			name:         "empty",
+			value:        "",
+			repositories: map[string]string{},
+			searchPath:   map[string]string{},
+		},
+		{name: "name only", value: "nixpkgs", err: true},
+		{name: "too many fields", value: "a=@a=nix/a=b", err: true},
+		{name: "missing name", value: "=@nixpkgs", err: true},
+		{name: "missing label", value: "a==nix/a", err: true},
+		{name: "missing path", value: "a=@a=", err: true},
+		{name: "missing label or path", value: "a=", err: true},
+		{name: "invalid label", value: "a=@a//:b:c", err: true},
+		{name: "duplicate name", value: "a=@a a=nix/a", err: true},
+		{name: "absolute path", value: "a=/nix/a", err: true},
+		{name: "path outside the workspace", value: "a=nix/../../a", err: true},
+		{name: "unterminated quote", value: `a="@a`, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repositories, searchPath, err := parseRepositoryEntries(tt.value)
+			if tt.err {
+				if !errors.Is(err, errParse) {
+					t.Fatalf("parseRepositoryEntries(%q) error = %v, want a parse error", tt.value, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRepositoryEntries(%q) error = %v", tt.value, err)
+			}
+			if !reflect.DeepEqual(repositories, tt.repositories) {
+				t.Errorf("parseRepositoryEntries(%q) repositories = %v, want %v", tt.value, repositories, tt.repositories)
+			}
+			if !reflect.DeepEqual(searchPath, tt.searchPath) {
+				t.Errorf("parseRepositoryEntries(%q) search path = %v, want %v", tt.value, searchPath, tt.searchPath)
+			}
+		})
+	}
+}
+
+func TestParsePatterns(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+		err   bool
+	}{
+		{value: "", want: nil},
+		{value: "  git   nix-*  ", want: []string{"git", "nix-*"}},
+		{value: "[a-z]?sh", want: []string{"[a-z]?sh"}},
+		{value: "git [a-", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parsePatterns(tt.value)
+		if tt.err {
+			if !errors.Is(err, errParse) {
+				t.Errorf("parsePatterns(%q) error = %v, want a parse error", tt.value, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePatterns(%q) error = %v", tt.value, err)
+			continue
+		}
+		if !equalStrings(got, tt.want) {
+			t.Errorf("parsePatterns(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestResolveFileArgument(t *testing.T) {
+	repoRoot := writeWorkspace(t, map[string]string{
+		"default.nix":         "",
+		"nix/prelude.nix":     "",
+		"sub/nix/overlay.nix": "",
+	})
+
+	tests := []struct {
+		name     string
+		relative string
+		value    string
+		file     string
+		label    string
+		err      bool
+	}{
+		{
+			name:  "label of the root package",
+			value: "//:default.nix",
+			file:  "default.nix",
+			label: "//:default.nix",
+		},
+		{
+			name:  "label keeping its package",
+			value: "//:nix/prelude.nix",
+			file:  "nix/prelude.nix",
+			label: "//:nix/prelude.nix",
+		},
+		{
+			name:     "relative label",
+			relative: "sub",
+			value:    ":nix/overlay.nix",
+			file:     "sub/nix/overlay.nix",
+			label:    "//sub:nix/overlay.nix",
+		},
+		{
+			name:     "path",
+			relative: "sub",
+			value:    "nix/overlay.nix",
+			file:     "sub/nix/overlay.nix",
+			label:    "//sub/nix:overlay.nix",
+		},
+		{name: "missing file", value: "//:missing.nix", err: true},
+		{name: "external label", value: "@nixpkgs//:default.nix", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, fileLabel, err := resolveFileArgument(repoRoot, tt.relative, tt.value)
+			if tt.err {
+				if !errors.Is(err, errParse) {
+					t.Fatalf("resolveFileArgument() error = %v, want a parse error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if file != tt.file || fileLabel != tt.label {
+				t.Errorf("resolveFileArgument() = %q, %q, want %q, %q", file, fileLabel, tt.file, tt.label)
+			}
+		})
+	}
+}
+
+func TestNixRepositoriesCopyOnWrite(t *testing.T) {
+	root := nixconfig.New()
+	if err := parseNixRepositories(root, "nixpkgs=@nixpkgs=nix/nixpkgs.nix lib=@lib"); err != nil {
+		t.Fatal(err)
+	}
+	wantRoot := map[string]string{"nixpkgs": "@nixpkgs", "lib": "@lib"}
+	wantRootSearchPath := map[string]string{"nixpkgs": "nix/nixpkgs.nix"}
+
+	tests := []struct {
+		name       string
+		parse      func(*nixconfig.NixLanguageConfig, string) error
+		value      string
+		want       map[string]string
+		searchPath map[string]string
+	}{
+		{
+			name:       "add",
+			parse:      parseNixRepositoriesAdd,
+			value:      "tools=@tools=nix/tools.nix",
+			want:       map[string]string{"nixpkgs": "@nixpkgs", "lib": "@lib", "tools": "@tools"},
+			searchPath: map[string]string{"nixpkgs": "nix/nixpkgs.nix", "tools": "nix/tools.nix"},
+		},
+		{
+			name:       "remove",
+			parse:      parseNixRepositoriesRemove,
+			value:      "nixpkgs",
+			want:       map[string]string{"lib": "@lib"},
+			searchPath: map[string]string{},
+		},
+		{
+			name:       "reset",
+			parse:      parseNixRepositoriesReset,
+			want:       map[string]string{},
+			searchPath: map[string]string{},
+		},
+	}
+
+	children := make([]*nixconfig.NixLanguageConfig, len(tests))
+	for i, tt := range tests {
+		children[i] = root.NewChild()
+		if err := tt.parse(children[i], tt.value); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+	}
+	sibling := root.NewChild()
+
+	for i, tt := range tests {
+		if !reflect.DeepEqual(children[i].NixRepositories, tt.want) {
+			t.Errorf("%s: NixRepositories = %v, want %v", tt.name, children[i].NixRepositories, tt.want)
+		}
+		if !reflect.DeepEqual(children[i].NixSearchPath, tt.searchPath) {
+			t.Errorf("%s: NixSearchPath = %v, want %v", tt.name, children[i].NixSearchPath, tt.searchPath)
+		}
+	}
+	for name, cfg := range map[string]*nixconfig.NixLanguageConfig{"parent": root, "sibling": sibling} {
+		if !reflect.DeepEqual(cfg.NixRepositories, wantRoot) {
+			t.Errorf("%s NixRepositories = %v, want %v", name, cfg.NixRepositories, wantRoot)
+		}
+		if !reflect.DeepEqual(cfg.NixSearchPath, wantRootSearchPath) {
+			t.Errorf("%s NixSearchPath = %v, want %v", name, cfg.NixSearchPath, wantRootSearchPath)
+		}
+	}
+}
+
+func TestParseNixArg(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		args    map[string]string
+		argStrs map[string]string
+		err     bool
+	}{
+		{
+			name:    "expression",
+			key:     nixconfig.NIX_ARG,
+			value:   "pkgs import <nixpkgs> { }",
+			args:    map[string]string{"pkgs": "import <nixpkgs> { }", "system": `"x86_64-linux"`},
+			argStrs: map[string]string{"version": "1.0"},
+		},
+		{
+			name:    "string replacing an expression",
+			key:     nixconfig.NIX_ARGSTR,
+			value:   "system  aarch64-linux",
+			args:    map[string]string{},
+			argStrs: map[string]string{"system": "aarch64-linux", "version": "1.0"},
+		},
+		{
+			name:    "name alone removes",
+			key:     nixconfig.NIX_ARGSTR,
+			value:   "version",
+			args:    map[string]string{"system": `"x86_64-linux"`},
+			argStrs: map[string]string{},
+		},
+		{name: "invalid name", key: nixconfig.NIX_ARG, value: "1pkgs {}", err: true},
+		{name: "empty", key: nixconfig.NIX_ARG, value: "", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := nixconfig.New()
+			parent.NixArgs = map[string]string{"system": `"x86_64-linux"`}
+			parent.NixArgStrs = map[string]string{"version": "1.0"}
+			child := parent.NewChild()
+
+			err := parseNixArg(child, tt.key, tt.value)
+			if tt.err {
+				if !errors.Is(err, errParse) {
+					t.Fatalf("parseNixArg() error = %v, want a parse error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(child.NixArgs, tt.args) || !reflect.DeepEqual(child.NixArgStrs, tt.argStrs) {
+				t.Errorf("parseNixArg() = %v, %v, want %v, %v", child.NixArgs, child.NixArgStrs, tt.args, tt.argStrs)
+			}
+			if len(parent.NixArgs) != 1 || len(parent.NixArgStrs) != 1 {
+				t.Errorf("parent arguments changed to %v, %v", parent.NixArgs, parent.NixArgStrs)
+			}
+		})
+	}
+}
+
+func TestParseNixOption(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  map[string]string
+		err   bool
+	}{
+		{
+			name:  "option",
+			value: "max-jobs 2",
+			want:  map[string]string{"max-jobs": "2", "sandbox": "true"},
+		},
+		{
+			name:  "value with whitespace",
+			value: "extra-experimental-features flakes nix-command",
+			want:  map[string]string{"extra-experimental-features": "flakes nix-command", "sandbox": "true"},
+		},
+		{
+			name:  "name alone removes",
+			value: "sandbox",
+			want:  map[string]string{},
+		},
+		{name: "reserved", value: "restrict-eval true", err: true},
+		{name: "reserved import-from-derivation", value: "allow-import-from-derivation false", err: true},
+		{name: "invalid name", value: "Max-jobs 2", err: true},
+		{name: "empty", value: "", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := nixconfig.New()
+			parent.NixOptions = map[string]string{"sandbox": "true"}
+			child := parent.NewChild()
+
+			err := parseNixOption(child, tt.value)
+			if tt.err {
+				if !errors.Is(err, errParse) {
+					t.Fatalf("parseNixOption() error = %v, want a parse error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(child.NixOptions, tt.want) {
+				t.Errorf("parseNixOption() = %v, want %v", child.NixOptions, tt.want)
+			}
+			if len(parent.NixOptions) != 1 {
+				t.Errorf("parent options changed to %v", parent.NixOptions)
+			}
+		})
+	}
+}
@@ -1,7 +1,11 @@
 package nixconfig
 
 import (
+	"errors"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
 )
@@ -9,27 +13,346 @@ import (
 const (
 	NIX_PRELUDE      = "nix_prelude"
 	NIX_REPOSITORIES = "nix_repositories"
+	NIX_TRACE_ALLOW  = "nix_trace_allow"
+	NIX_TRACE_DENY   = "nix_trace_deny"
+
+	NIX_REPOSITORIES_ADD    = "nix_repositories_add"
+	NIX_REPOSITORIES_REMOVE = "nix_repositories_remove"
+	NIX_REPOSITORIES_RESET  = "nix_repositories_reset"
+
+	NIX_WRITE_POLICY       = "nix_write_policy"
+	NIX_SENSITIVE_PATHS    = "nix_sensitive_paths"
+	NIX_READONLY_WORKSPACE = "nix_readonly_workspace"
+
+	NIX_EXTERNAL_INPUTS_POLICY = "nix_external_inputs_policy"
+	NIX_EXTERNAL_INPUTS_ALLOW  = "nix_external_inputs_allow"
+
+	NIX_RESTRICT_EVAL = "nix_restrict_eval"
+	NIX_ALLOWED_URIS  = "nix_allowed_uris"
+
+	NIX_ENV_ALLOW = "nix_env_allow"
+
+	NIX_IFD_POLICY = "nix_ifd_policy"
+
+	NIX_ATTRIBUTE_DISCOVERY = "nix_attribute_discovery"
+	NIX_OVERLAY             = "nix_overlay"
+	NIX_ATTRSET             = "nix_attrset"
+
+	NIX_TRACER     = "nix_tracer"
+	NIX_EVALUATOR  = "nix_evaluator"
+	NIX_TIMEOUT    = "nix_timeout"
+	NIX_KEEP_GOING = "nix_keep_going"
+
+	NIX_ARG    = "nix_arg"
+	NIX_ARGSTR = "nix_argstr"
+	NIX_OPTION = "nix_option"
+
+	NIX_PACKAGE_ATTR = "nix_package_attr"
+
+	NIX_NAME_PREFIX    = "nix_name_prefix"
+	NIX_NAME_SEPARATOR = "nix_name_separator"
+	NIX_NAME_STRIP     = "nix_name_strip"
+	NIX_NAME           = "nix_name"
+
+	NIX_ENABLED = "nix_enabled"
+	NIX_MODE    = "nix_mode"
+
+	NIX_IGNORE_MARKERS = "nix_ignore_markers"
 )
 
+// EvaluatorCLI is the command line interface of the evaluator.
+type EvaluatorCLI string
+
+const (
+	// CLI_AUTO detects the interface from the name of the binary.
+	CLI_AUTO EvaluatorCLI = "auto"
+	// CLI_LEGACY is nix-instantiate.
+	CLI_LEGACY EvaluatorCLI = "nix-instantiate"
+	// CLI_NIX is the nix command, e.g. nix eval.
+	CLI_NIX EvaluatorCLI = "nix"
+)
+
+var errEvaluatorCLI = errors.New("unknown evaluator interface, expected one of: auto, nix-instantiate, nix")
+
+// ParseEvaluatorCLI converts a flag or directive value into an
+// EvaluatorCLI.
+func ParseEvaluatorCLI(value string) (EvaluatorCLI, error) {
+	switch cli := EvaluatorCLI(strings.TrimSpace(value)); cli {
+	case CLI_AUTO, CLI_LEGACY, CLI_NIX:
+		return cli, nil
+	}
+
+	return "", errEvaluatorCLI
+}
+
+// Tracer is the backend recording the files accessed during evaluation.
+type Tracer string
+
+const (
+	TRACER_FPTRACE Tracer = "fptrace"
+	TRACER_STRACE  Tracer = "strace"
+)
+
+var errTracer = errors.New("unknown tracer, expected one of: fptrace, strace")
+
+// ParseTracer converts a flag or directive value into a Tracer.
+func ParseTracer(value string) (Tracer, error) {
+	switch tracer := Tracer(strings.TrimSpace(value)); tracer {
+	case TRACER_FPTRACE, TRACER_STRACE:
+		return tracer, nil
+	}
+
+	return "", errTracer
+}
+
+// Mode tells how the packages of a directory are defined.
+type Mode string
+
+const (
+	// MODE_AUTO detects the mode from the configuration, and from the
+	// files of the directory.
+	MODE_AUTO Mode = "auto"
+	// MODE_VANILLA evaluates default.nix files on their own.
+	MODE_VANILLA Mode = "vanilla"
+	// MODE_PRELUDE evaluates default.nix files as attributes of the
+	// prelude.
+	MODE_PRELUDE Mode = "prelude"
+	// MODE_FLAKE evaluates the packages of flake.nix files.
+	MODE_FLAKE Mode = "flake"
+	// MODE_OVERLAY evaluates the derivations of the configured overlay, or
+	// attribute set.
+	MODE_OVERLAY Mode = "overlay"
+)
+
+var errMode = errors.New("unknown mode, expected one of: auto, vanilla, prelude, flake, overlay")
+
+// ParseMode converts a directive value into a Mode.
+func ParseMode(value string) (Mode, error) {
+	switch mode := Mode(strings.TrimSpace(value)); mode {
+	case MODE_AUTO, MODE_VANILLA, MODE_PRELUDE, MODE_FLAKE, MODE_OVERLAY:
+		return mode, nil
+	}
+
+	return "", errMode
+}
+
+// DiscoveryKind tells what kind of expression is evaluated to discover
+// derivations.
+type DiscoveryKind string
+
+const (
+	DISCOVERY_OVERLAY DiscoveryKind = "overlay"
+	DISCOVERY_ATTRSET DiscoveryKind = "attrset"
+)
+
+// Discovery is an expression evaluated to discover derivations, which
+// are not defined by per-directory default.nix files.
+type Discovery struct {
+	Kind DiscoveryKind
+	// File is the workspace relative path of the overlay, or of the
+	// attribute set, and Label its label, as given by the directive.
+	File  string
+	Label string
+	// Arg is the search path entry of the package set the overlay is
+	// applied to, or the attribute path of the attribute set.
+	Arg string
+}
+
+// InputClass classifies the inputs of an evaluation that are located
+// outside of the workspace.
+type InputClass string
+
+const (
+	INPUT_STORE         InputClass = "store"
+	INPUT_SYSTEM_CONFIG InputClass = "system_config"
+	INPUT_USER_CONFIG   InputClass = "user_config"
+	INPUT_OTHER         InputClass = "other"
+)
+
+// InputClasses lists every InputClass, in reporting order.
+var InputClasses = []InputClass{
+	INPUT_STORE,
+	INPUT_SYSTEM_CONFIG,
+	INPUT_USER_CONFIG,
+	INPUT_OTHER,
+}
+
+// Policy tells how a detected problem is reported.
+type Policy string
+
+const (
+	POLICY_IGNORE Policy = "ignore"
+	POLICY_WARN   Policy = "warn"
+	POLICY_ERROR  Policy = "error"
+)
+
+var errPolicy = errors.New("unknown policy, expected one of: ignore, warn, error")
+
+// ParsePolicy converts a directive value into a Policy.
+func ParsePolicy(value string) (Policy, error) {
+	switch policy := Policy(strings.TrimSpace(value)); policy {
+	case POLICY_IGNORE, POLICY_WARN, POLICY_ERROR:
+		return policy, nil
+	}
+
+	return "", errPolicy
+}
+
 // NixLanguageConfig configuration for language extension.
 type NixLanguageConfig struct {
 	Parent *NixLanguageConfig
 
-	NixPrelude      string
-	NixRepositories map[string]string
-	NixPath         string
-	Config          config.Config
+	// NixPrelude is the workspace relative path of the prelude,
+	// NixPreludeLabel its label, as given by the directive, and
+	// NixPreludeRoot the directory declaring it. Attribute paths are
+	// computed relative to NixPreludeRoot, and prefixed with
+	// NixPreludeAttrPrefix.
+	NixPrelude           string
+	NixPreludeLabel      string
+	NixPreludeRoot       string
+	NixPreludeAttrPrefix string
+	NixRepositories      map[string]string
+	// NixSearchPath maps nix search path entries to the workspace
+	// relative paths they resolve to.
+	NixSearchPath map[string]string
+	// TraceAllow and TraceDeny are glob patterns matched against the
+	// names of traced processes, deciding whose inputs are kept.
+	TraceAllow []string
+	TraceDeny  []string
+	// WritePolicy tells how writes to the workspace, or to one of the
+	// SensitivePaths, made during evaluation are reported.
+	WritePolicy       Policy
+	SensitivePaths    []string
+	ReadOnlyWorkspace bool
+	// ExternalInputPolicies tells how inputs from outside of the
+	// workspace are reported, per class, unless they match one of the
+	// ExternalInputAllow patterns.
+	ExternalInputPolicies map[InputClass]Policy
+	ExternalInputAllow    []string
+	// RestrictEval enables restricted evaluation, limiting accessible
+	// paths to the workspace and the configured repositories, and
+	// accessible URIs to AllowedURIs.
+	RestrictEval bool
+	AllowedURIs  []string
+	// EnvAllow lists the variables of the user environment passed to the
+	// evaluation, on top of the default ones.
+	EnvAllow []string
+	// IFDPolicy tells how packages using import-from-derivation are
+	// reported. POLICY_ERROR disables import-from-derivation altogether.
+	IFDPolicy Policy
+	// IFDProbe evaluates packages a second time, untraced, with
+	// import-from-derivation disabled, to catch derivations realised by
+	// the daemon.
+	IFDProbe bool
+	// AttributeDiscovery lists the attribute paths, relative to the
+	// prelude attribute prefix, of the subtrees evaluated to discover the
+	// attribute paths of packages. "" stands for the whole prelude. When
+	// empty, attribute paths are derived from directory paths.
+	AttributeDiscovery []string
+	// Discovery, when set, replaces per-directory default.nix files with
+	// the derivations discovered by evaluating an overlay, or an
+	// attribute set.
+	Discovery *Discovery
+	// Tracer and Evaluator are the tracing backend, and the evaluator
+	// binary, used for evaluations. The evaluator is given as a label, a
+	// path, or a name looked up in PATH, and is invoked through
+	// EvaluatorCLI.
+	Tracer       Tracer
+	TracerPath   string
+	Evaluator    string
+	EvaluatorCLI EvaluatorCLI
+	// Jobs bounds the number of concurrent evaluations, and CacheDir,
+	// when set, is where traces are cached across runs. Both apply to
+	// the whole run, and are only set by flags.
+	Jobs     int
+	CacheDir string
+	// Timeout bounds the duration of a single evaluation, when positive.
+	Timeout time.Duration
+	// KeepGoing tells whether generation continues after a package
+	// failed, instead of stopping altogether.
+	KeepGoing bool
+	// NixArgs and NixArgStrs are the arguments functions are called with,
+	// by name, given as nix expressions, and as strings. NixOptions are
+	// the nix options set for evaluations, and builds.
+	NixArgs    map[string]string
+	NixArgStrs map[string]string
+	NixOptions map[string]string
+	// PackageAttrs are extra attributes of the generated rules, by name,
+	// holding bool, string or []string values. PackageAttrOverrides
+	// override them for the derivations discovered at an attribute path,
+	// where a nil value removes the attribute.
+	PackageAttrs         map[string]interface{}
+	PackageAttrOverrides map[string]map[string]interface{}
+	// NamePrefix, NameSeparator and NameStrip define how repository names
+	// are derived from directory paths, or attribute paths: the leading
+	// NameStrip components are dropped, and the remaining ones are joined
+	// with NameSeparator, after NamePrefix.
+	NamePrefix    string
+	NameSeparator string
+	NameStrip     int
+	// Names are explicit repository names of the packages of the
+	// directory, by attribute path, "" standing for the default.nix
+	// package. They are not inherited.
+	Names map[string]string
+	// Enabled tells whether rules are generated in the subtree, and Mode
+	// how its packages are defined.
+	Enabled bool
+	Mode    Mode
+	// IgnoreMarkers are the names of the files marking a directory, and
+	// its subdirectories, as ignored. Ignored tells whether the directory
+	// is marked so, or is below a marked directory.
+	IgnoreMarkers []string
+	Ignored       bool
+	Config        config.Config
 }
 
 // NewChild creates a new child Config. It inherits desired values from the
-// current Config and sets itself as the parent to the child.
+// current Config and sets itself as the parent to the child. Maps are
+// shared with the parent, and must be copied before being modified.
 func (c *NixLanguageConfig) NewChild() *NixLanguageConfig {
 	return &NixLanguageConfig{
-		Parent:          c,
-		NixPrelude:      c.NixPrelude,
-		NixRepositories: c.NixRepositories,
-		NixPath:         c.NixPath,
-		Config:          c.Config,
+		Parent:                c,
+		NixPrelude:            c.NixPrelude,
+		NixPreludeLabel:       c.NixPreludeLabel,
+		NixPreludeRoot:        c.NixPreludeRoot,
+		NixPreludeAttrPrefix:  c.NixPreludeAttrPrefix,
+		NixRepositories:       c.NixRepositories,
+		NixSearchPath:         c.NixSearchPath,
+		TraceAllow:            c.TraceAllow,
+		TraceDeny:             c.TraceDeny,
+		WritePolicy:           c.WritePolicy,
+		SensitivePaths:        c.SensitivePaths,
+		ReadOnlyWorkspace:     c.ReadOnlyWorkspace,
+		ExternalInputPolicies: c.ExternalInputPolicies,
+		ExternalInputAllow:    c.ExternalInputAllow,
+		RestrictEval:          c.RestrictEval,
+		AllowedURIs:           c.AllowedURIs,
+		EnvAllow:              c.EnvAllow,
+		IFDPolicy:             c.IFDPolicy,
+		IFDProbe:              c.IFDProbe,
+		AttributeDiscovery:    c.AttributeDiscovery,
+		Discovery:             c.Discovery,
+		Tracer:                c.Tracer,
+		TracerPath:            c.TracerPath,
+		Evaluator:             c.Evaluator,
+		EvaluatorCLI:          c.EvaluatorCLI,
+		Jobs:                  c.Jobs,
+		CacheDir:              c.CacheDir,
+		Timeout:               c.Timeout,
+		KeepGoing:             c.KeepGoing,
+		NixArgs:               c.NixArgs,
+		NixArgStrs:            c.NixArgStrs,
+		NixOptions:            c.NixOptions,
+		PackageAttrs:          c.PackageAttrs,
+		PackageAttrOverrides:  c.PackageAttrOverrides,
+		NamePrefix:            c.NamePrefix,
+		NameSeparator:         c.NameSeparator,
+		NameStrip:             c.NameStrip,
+		Enabled:               c.Enabled,
+		Mode:                  c.Mode,
+		IgnoreMarkers:         c.IgnoreMarkers,
+		Ignored:               c.Ignored,
+		Config:                c.Config,
 	}
 }
 
@@ -38,8 +361,33 @@ func New() *NixLanguageConfig {
 	return &NixLanguageConfig{
 		NixPrelude:      "",
 		NixRepositories: make(map[string]string),
-		NixPath:         "",
-		Config:          *config.New(),
+		NixSearchPath:   make(map[string]string),
+		WritePolicy:     POLICY_WARN,
+		ExternalInputPolicies: map[InputClass]Policy{
+			INPUT_STORE:         POLICY_IGNORE,
+			INPUT_SYSTEM_CONFIG: POLICY_IGNORE,
+			INPUT_USER_CONFIG:   POLICY_IGNORE,
+			INPUT_OTHER:         POLICY_IGNORE,
+		},
+		IFDPolicy:            POLICY_WARN,
+		Tracer:               TRACER_FPTRACE,
+		Evaluator:            "nix-instantiate",
+		EvaluatorCLI:         CLI_AUTO,
+		Jobs:                 runtime.NumCPU(),
+		KeepGoing:            true,
+		NixArgs:              make(map[string]string),
+		NixArgStrs:           make(map[string]string),
+		NixOptions:           make(map[string]string),
+		PackageAttrs:         make(map[string]interface{}),
+		PackageAttrOverrides: make(map[string]map[string]interface{}),
+		NameSeparator:        ".",
+		Enabled:              true,
+		Mode:                 MODE_AUTO,
+		IgnoreMarkers: []string{
+			".nix-ignore-directory",
+			".nix-ignore-subdirectory",
+		},
+		Config: *config.New(),
 	}
 }
 
@@ -0,0 +1,203 @@
+package gazelle
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+const (
+	ATTR_FAIL_NOT_SUPPORTED = "fail_not_supported"
+	ATTR_QUIET              = "quiet"
+	ATTR_BUILD_FILE_CONTENT = "build_file_content"
+	ATTR_NIXOPTS            = "nixopts"
+	ATTR_TAGS               = "tags"
+	// ATTR_EXPORTS_VISIBILITY is the visibility of the exports filegroup,
+	// rather than an attribute of the manifest.
+	ATTR_EXPORTS_VISIBILITY = "exports_visibility"
+)
+
+// packageAttrParsers parse the values of the attributes which can be set
+// with the nix_package_attr directive.
+var packageAttrParsers = map[string]func(string) (interface{}, error){
+	ATTR_FAIL_NOT_SUPPORTED: parseBoolAttr,
+	ATTR_QUIET:              parseBoolAttr,
+	ATTR_BUILD_FILE_CONTENT: parseStringAttr,
+	ATTR_NIXOPTS:            parseListAttr,
+	ATTR_TAGS:               parseListAttr,
+	ATTR_EXPORTS_VISIBILITY: parseLabelListAttr,
+}
+
+// manifestAttrs lists the attributes of nix_package_attr set on the
+// manifests. They are mergeable, so that a changed directive updates
+// existing rules, unless their values are marked with # keep.
+var manifestAttrs = []string{
+	ATTR_FAIL_NOT_SUPPORTED,
+	ATTR_QUIET,
+	ATTR_BUILD_FILE_CONTENT,
+	ATTR_NIXOPTS,
+	ATTR_TAGS,
+}
+
+func parseBoolAttr(value string) (interface{}, error) {
+	return strconv.ParseBool(value)
+}
+
+// parseStringAttr parses a string, either verbatim, or quoted to use
+// escape sequences such as \n.
+func parseStringAttr(value string) (interface{}, error) {
+	if strings.HasPrefix(value, `"`) {
+		return strconv.Unquote(value)
+	}
+
+	return value, nil
+}
+
+// parseListAttr parses a whitespace separated list of strings, any of
+// which may be quoted.
+func parseListAttr(value string) (interface{}, error) {
+	tokens, err := tokenizeDirective(value)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		list = append(list, strings.Join(token.fields, "="))
+	}
+
+	return list, nil
+}
+
+func parseLabelListAttr(value string) (interface{}, error) {
+	labels := strings.Fields(value)
+	for _, l := range labels {
+		if _, err := label.Parse(l); err != nil {
+			return nil, fmt.Errorf("invalid label %q: %v", l, err)
+		}
+	}
+
+	return labels, nil
+}
+
+// evaluationNixopts are the nixopts changing the traced evaluation, which
+// are set by directives instead, so that the evaluation is traced the way
+// it is built.
+var evaluationNixopts = map[string]string{
+	"--arg":     nixconfig.NIX_ARG,
+	"--argstr":  nixconfig.NIX_ARGSTR,
+	"--option":  nixconfig.NIX_OPTION,
+	"-I":        nixconfig.NIX_REPOSITORIES,
+	"--include": nixconfig.NIX_REPOSITORIES,
+}
+
+// parseNixPackageAttr sets an attribute of the rules generated for the
+// packages of the subtree, given as a key followed by its value, or as
+// <attribute path>=<key> for the derivation discovered at the attribute
+// path only. A key alone removes the inherited attribute.
+func parseNixPackageAttr(nixConfig *nixconfig.NixLanguageConfig, value string) error {
+	key, attrValue := splitNameValue(value)
+
+	attrPath := ""
+	if i := strings.LastIndex(key, "="); i >= 0 {
+		attrPath, key = key[:i], key[i+1:]
+		if !attrPathRegex.MatchString(attrPath) {
+			return fmt.Errorf("%w: invalid attribute path %q", errParse, attrPath)
+		}
+	}
+
+	parse, ok := packageAttrParsers[key]
+	if !ok {
+		keys := make([]string, 0, len(packageAttrParsers))
+		for k := range packageAttrParsers {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return fmt.Errorf("%w: unknown attribute %q, expected one of: %s", errParse, key, strings.Join(keys, ", "))
+	}
+
+	var parsed interface{}
+	if attrValue != "" {
+		var err error
+		if parsed, err = parse(attrValue); err != nil {
+			return fmt.Errorf("%w: %s: %v", errParse, key, err)
+		}
+	}
+	if nixopts, ok := parsed.([]string); ok && key == ATTR_NIXOPTS {
+		for _, opt := range nixopts {
+			if directive, ok := evaluationNixopts[opt]; ok {
+				return fmt.Errorf("%w: %s: %s changes the evaluation, set it with the %s directive", errParse, key, opt, directive)
+			}
+		}
+	}
+
+	if attrPath != "" {
+		overrides := make(map[string]map[string]interface{}, len(nixConfig.PackageAttrOverrides)+1)
+		for k, v := range nixConfig.PackageAttrOverrides {
+			overrides[k] = v
+		}
+		attrs := make(map[string]interface{}, len(overrides[attrPath])+1)
+		for k, v := range overrides[attrPath] {
+			attrs[k] = v
+		}
+		attrs[key] = parsed
+		overrides[attrPath] = attrs
+
+		nixConfig.PackageAttrOverrides = overrides
+		return nil
+	}
+
+	attrs := make(map[string]interface{}, len(nixConfig.PackageAttrs))
+	for k, v := range nixConfig.PackageAttrs {
+		attrs[k] = v
+	}
+	delete(attrs, key)
+	if parsed != nil {
+		attrs[key] = parsed
+	}
+
+	nixConfig.PackageAttrs = attrs
+	return nil
+}
+
+// packageAttr returns the configured attribute of the package, given by
+// attribute path for discovered derivations, or "" otherwise.
+func packageAttr(nixCfg *nixconfig.NixLanguageConfig, attrPath string, key string) (interface{}, bool) {
+	if value, ok := nixCfg.PackageAttrOverrides[attrPath][key]; ok {
+		return value, value != nil
+	}
+	value, ok := nixCfg.PackageAttrs[key]
+
+	return value, ok
+}
+
+// setManifestAttrs sets the configured attributes of the manifest of the
+// package, given as for packageAttr. The configured nixopts are appended
+// to those derived from nix_arg, nix_argstr and nix_option.
+func setManifestAttrs(nixCfg *nixconfig.NixLanguageConfig, attrPath string, nrap *NixRuleArgs) {
+	nixopts := manifestNixopts(nixCfg)
+	if extra, ok := packageAttr(nixCfg, attrPath, ATTR_NIXOPTS); ok {
+		nixopts = append(nixopts, extra.([]string)...)
+	}
+	if len(nixopts) > 0 {
+		nrap.attrs[ATTR_NIXOPTS] = nixopts
+	}
+
+	for _, key := range manifestAttrs {
+		if value, ok := packageAttr(nixCfg, attrPath, key); ok && key != ATTR_NIXOPTS {
+			nrap.attrs[key] = value
+		}
+	}
+}
+
+// setExportsAttrs sets the configured attributes of the exports
+// filegroup.
+func setExportsAttrs(nixCfg *nixconfig.NixLanguageConfig, nrae *NixRuleArgs) {
+	if visibility, ok := packageAttr(nixCfg, "", ATTR_EXPORTS_VISIBILITY); ok {
+		nrae.attrs["visibility"] = visibility
+	}
+}
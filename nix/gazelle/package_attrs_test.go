@@ -0,0 +1,216 @@
+package gazelle
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/rule"
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+func TestParseNixPackageAttr(t *testing.T) {
+	tests := []struct {
+		name      string
+		inherited map[string]interface{}
+		value     string
+		want      map[string]interface{}
+		err       bool
+	}{
+		{
+			name:  "bool",
+			value: "quiet true",
+			want:  map[string]interface{}{ATTR_QUIET: true},
+		},
+		{
+			name:  "verbatim string",
+			value: "build_file_content   exports_files([\"bin\"])",
+			want:  map[string]interface{}{ATTR_BUILD_FILE_CONTENT: `exports_files(["bin"])`},
+		},
+		{
+			name:  "quoted string",
+			value: `build_file_content "a\nb"`,
+			want:  map[string]interface{}{ATTR_BUILD_FILE_CONTENT: "a\nb"},
+		},
+		{
+			name:  "list with quoted = and repeated spaces",
+			value: `tags   manual  "key=a b"`,
+			want:  map[string]interface{}{ATTR_TAGS: []string{"manual", "key=a b"}},
+		},
+		{
+			name:  "label list",
+			value: "exports_visibility //visibility:public @repo//pkg:__pkg__",
+			want:  map[string]interface{}{ATTR_EXPORTS_VISIBILITY: []string{"//visibility:public", "@repo//pkg:__pkg__"}},
+		},
+		{
+			name:      "overrides the inherited value",
+			inherited: map[string]interface{}{ATTR_QUIET: true, ATTR_TAGS: []string{"manual"}},
+			value:     "quiet false",
+			want:      map[string]interface{}{ATTR_QUIET: false, ATTR_TAGS: []string{"manual"}},
+		},
+		{
+			name:      "key alone removes the inherited value",
+			inherited: map[string]interface{}{ATTR_QUIET: true, ATTR_TAGS: []string{"manual"}},
+			value:     "tags",
+			want:      map[string]interface{}{ATTR_QUIET: true},
+		},
+		{
+			name:  "nixopts",
+			value: "nixopts --keep-going --max-jobs 2",
+			want:  map[string]interface{}{ATTR_NIXOPTS: []string{"--keep-going", "--max-jobs", "2"}},
+		},
+		{name: "nixopts with --arg", value: "nixopts --arg pkgs {}", err: true},
+		{name: "nixopts with --argstr", value: "nixopts --argstr system x86_64-linux", err: true},
+		{name: "nixopts with --option", value: "nixopts --option cores 2", err: true},
+		{name: "nixopts with -I", value: "nixopts -I nixpkgs=/nix", err: true},
+		{name: "unknown key", value: "visibility //visibility:public", err: true},
+		{name: "per-package unknown key", value: "hello=visibility //visibility:public", err: true},
+		{name: "per-package invalid attribute path", value: "hello..world=quiet true", err: true},
+		{name: "per-package nixopts with --arg", value: "hello=nixopts --arg pkgs {}", err: true},
+		{name: "invalid bool", value: "quiet maybe", err: true},
+		{name: "unterminated quote", value: `tags "manual`, err: true},
+		{name: "invalid quoted string", value: `build_file_content "a`, err: true},
+		{name: "invalid label", value: "exports_visibility //a:b:c", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nixConfig := &nixconfig.NixLanguageConfig{PackageAttrs: tt.inherited}
+			err := parseNixPackageAttr(nixConfig, tt.value)
+			if tt.err {
+				if !errors.Is(err, errParse) {
+					t.Fatalf("parseNixPackageAttr(%q) error = %v, want a parse error", tt.value, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseNixPackageAttr(%q) error = %v", tt.value, err)
+			}
+			if !reflect.DeepEqual(nixConfig.PackageAttrs, tt.want) {
+				t.Errorf("parseNixPackageAttr(%q) = %v, want %v", tt.value, nixConfig.PackageAttrs, tt.want)
+			}
+			if tt.inherited != nil && reflect.DeepEqual(nixConfig.PackageAttrs, tt.inherited) {
+				t.Errorf("parseNixPackageAttr(%q) modified the inherited attributes", tt.value)
+			}
+		})
+	}
+}
+
+func TestParseNixPackageAttrPerPackage(t *testing.T) {
+	inherited := map[string]map[string]interface{}{
+		"hello": {ATTR_QUIET: true},
+	}
+	nixConfig := &nixconfig.NixLanguageConfig{
+		PackageAttrs:         map[string]interface{}{ATTR_TAGS: []string{"manual"}},
+		PackageAttrOverrides: inherited,
+	}
+
+	for _, value := range []string{
+		"hello=tags",
+		"tools.cowsay=tags   nix  \"key=a b\"",
+	} {
+		if err := parseNixPackageAttr(nixConfig, value); err != nil {
+			t.Fatalf("parseNixPackageAttr(%q) error = %v", value, err)
+		}
+	}
+
+	want := map[string]map[string]interface{}{
+		"hello":        {ATTR_QUIET: true, ATTR_TAGS: nil},
+		"tools.cowsay": {ATTR_TAGS: []string{"nix", "key=a b"}},
+	}
+	if !reflect.DeepEqual(nixConfig.PackageAttrOverrides, want) {
+		t.Errorf("PackageAttrOverrides = %v, want %v", nixConfig.PackageAttrOverrides, want)
+	}
+	if want := map[string]interface{}{ATTR_TAGS: []string{"manual"}}; !reflect.DeepEqual(nixConfig.PackageAttrs, want) {
+		t.Errorf("PackageAttrs = %v, want %v", nixConfig.PackageAttrs, want)
+	}
+	if want := map[string]interface{}{ATTR_QUIET: true}; !reflect.DeepEqual(inherited["hello"], want) {
+		t.Errorf("parseNixPackageAttr modified the inherited overrides: %v", inherited)
+	}
+}
+
+func TestSetManifestAttrs(t *testing.T) {
+	nixConfig := &nixconfig.NixLanguageConfig{
+		NixArgs: map[string]string{"pkgs": "import <nixpkgs> { }"},
+		PackageAttrs: map[string]interface{}{
+			ATTR_QUIET:   true,
+			ATTR_TAGS:    []string{"manual"},
+			ATTR_NIXOPTS: []string{"--keep-going"},
+		},
+		PackageAttrOverrides: map[string]map[string]interface{}{
+			"hello": {ATTR_TAGS: nil, ATTR_NIXOPTS: []string{"--max-jobs", "2"}},
+		},
+	}
+
+	tests := []struct {
+		attrPath string
+		want     map[string]interface{}
+	}{
+		{
+			attrPath: "",
+			want: map[string]interface{}{
+				ATTR_QUIET:   true,
+				ATTR_TAGS:    []string{"manual"},
+				ATTR_NIXOPTS: []string{"--arg", "pkgs", "import <nixpkgs> { }", "--keep-going"},
+			},
+		},
+		{
+			attrPath: "hello",
+			want: map[string]interface{}{
+				ATTR_QUIET:   true,
+				ATTR_NIXOPTS: []string{"--arg", "pkgs", "import <nixpkgs> { }", "--max-jobs", "2"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		nrap := &NixRuleArgs{attrs: map[string]interface{}{}}
+		setManifestAttrs(nixConfig, tt.attrPath, nrap)
+		if !reflect.DeepEqual(nrap.attrs, tt.want) {
+			t.Errorf("setManifestAttrs(%q) = %v, want %v", tt.attrPath, nrap.attrs, tt.want)
+		}
+	}
+}
+
+func TestPackageAttrsAreMergeable(t *testing.T) {
+	kinds := (&nixLang{}).Kinds()
+	for _, kind := range []string{MANIFEST_RULE, PACKAGE_RULE} {
+		for _, key := range manifestAttrs {
+			if !kinds[kind].MergeableAttrs[key] {
+				t.Errorf("%s attribute %s is not mergeable, changed directives would not apply", kind, key)
+			}
+		}
+	}
+	if !kinds[EXPORT_RULE].MergeableAttrs["visibility"] {
+		t.Errorf("%s visibility is not mergeable, changed directives would not apply", EXPORT_RULE)
+	}
+}
+
+func TestChangedPackageAttrsUpdateRules(t *testing.T) {
+	existing := `nixpkgs_package_manifest(
+    name = "hello",
+    quiet = True,
+    tags = ["old"],
+    build_file_content = "exports_files([\"bin\"])",  # keep
+)
+`
+	f, err := rule.LoadData("BUILD.bazel", "", []byte(existing))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generated := rule.NewRule(MANIFEST_RULE, "hello")
+	generated.SetAttr(ATTR_TAGS, []string{"new"})
+	rule.MergeRules(generated, f.Rules[0], (&nixLang{}).Kinds()[MANIFEST_RULE].MergeableAttrs, "BUILD.bazel")
+
+	merged := f.Rules[0]
+	if got := merged.AttrStrings(ATTR_TAGS); !equalStrings(got, []string{"new"}) {
+		t.Errorf("tags = %q, want %q", got, []string{"new"})
+	}
+	if merged.Attr(ATTR_QUIET) != nil {
+		t.Errorf("quiet was kept, but is no longer set by the directive")
+	}
+	if got := merged.AttrString(ATTR_BUILD_FILE_CONTENT); got != `exports_files(["bin"])` {
+		t.Errorf("build_file_content = %q, the value marked with # keep was changed", got)
+	}
+}
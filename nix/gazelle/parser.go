@@ -3,39 +3,52 @@ package gazelle
 import (
 	"bufio"
 	"bytes"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/bazelbuild/bazel-gazelle/pathtools"
-	"github.com/bazelbuild/rules_go/go/tools/bazel"
+	"github.com/bazelbuild/bazel-gazelle/rule"
 	"github.com/lainio/err2"
 	"github.com/lainio/err2/try"
 	"github.com/rs/zerolog"
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
 )
 
 type (
-	TraceOuts []struct {
-		Cmd struct {
-			Parent int
-			ID     int
-			Dir    string
-			Path   string
-			Args   []string
-		}
+	// TraceCmd describes a single process spawned during the traced
+	// evaluation.
+	TraceCmd struct {
+		Parent int
+		ID     int
+		Dir    string
+		Path   string
+		Args   []string
+	}
+
+	// TraceProcess holds the files accessed by a single traced process.
+	// Missing are the files it looked up but did not find, which only
+	// strace reports: they are not dependencies, but creating one of
+	// them may change the result of the evaluation.
+	TraceProcess struct {
+		Cmd     TraceCmd
 		Inputs  []string
 		Outputs []string
+		Missing []string
 		FDs     struct {
 			Num0 string
 			Num1 string
 			Num2 string
 		}
 	}
+
+	TraceOuts []TraceProcess
 )
+
 type LogEvent struct {
 	Path      string
 	Runfile   string
@@ -87,30 +100,30 @@ func (l LogEvent) Send(logger *zerolog.Logger) {
 
 }
 
-func getBazelPackage(workspaceRoot string, filePath string) string {
-	var getNixBzlPackage func(string) string
-	getNixBzlPackage = func(dir string) string {
-		// TODO: NESTED default.nixes in Workspace
-		parentDirContainsNixPackageMarker := fileExists(filepath.Join(dir, "default.nix"))
-		if parentDirContainsNixPackageMarker {
-			return "//" + pathtools.TrimPrefix(
-				dir,
-				workspaceRoot,
-			)
+// getBazelPackage returns the nix package owning the file: the closest
+// directory, up to the workspace root, containing a default.nix file.
+// Files of a nested package belong to the nested package only. With
+// buildPackages, directories containing a BUILD file own their files
+// too, as do the directories of the packages discovered from an overlay
+// or attribute set, which have no default.nix file.
+func getBazelPackage(workspaceRoot string, filePath string, buildPackages bool) string {
+	dir := filepath.Dir(filePath)
+	for pathtools.HasPrefix(dir, workspaceRoot) && dir != workspaceRoot {
+		if fileExists(filepath.Join(dir, "default.nix")) {
+			break
 		}
-
-		if dir == "/" {
-			panic("Attempted to find the parent directory of '/'")
+		if buildPackages &&
+			(fileExists(filepath.Join(dir, "BUILD.bazel")) || fileExists(filepath.Join(dir, "BUILD"))) {
+			break
 		}
-		return getNixBzlPackage(filepath.Dir(dir))
+		dir = filepath.Dir(dir)
 	}
 
-	fileDir := filepath.Dir(filePath)
-	return getNixBzlPackage(fileDir)
+	return "//" + pathtools.TrimPrefix(dir, workspaceRoot)
 }
 
-func getBazelTarget(workspaceRoot string, filePath string) string {
-	bazelPackage := getBazelPackage(workspaceRoot, filePath)
+func getBazelTarget(workspaceRoot string, filePath string, buildPackages bool) string {
+	bazelPackage := getBazelPackage(workspaceRoot, filePath, buildPackages)
 	return fmt.Sprintf(
 		"%s:%s",
 		bazelPackage,
@@ -121,32 +134,185 @@ func getBazelTarget(workspaceRoot string, filePath string) string {
 	)
 }
 
-func parseFpTraceOutput(workspaceRoot string, rootNixDerivPath string, outputs *TraceOuts) (_, _ []string) {
+// isSubPackage tells if the child package is nested below the parent
+// package, both given as //-prefixed labels.
+func isSubPackage(parent string, child string) bool {
+	parentDir := strings.TrimPrefix(parent, "//")
+	childDir := strings.TrimPrefix(child, "//")
+
+	return parentDir != childDir && pathtools.HasPrefix(childDir, parentDir)
+}
+
+// exportsLabel returns the label of the filegroup exporting the files of
+// the nix package.
+func exportsLabel(pkg string) string {
+	rel := strings.TrimPrefix(pkg, "//")
+	return fmt.Sprintf("%s:%s", pkg, exportsName(rel))
+}
+
+var (
+	// visitedDirs are the directories rules were generated for during
+	// the run, and exportingDirs those among them which produced their
+	// exports. Gazelle visits subdirectories first, so nested packages
+	// are known by the time their parent is evaluated.
+	visitedDirs      = make(map[string]bool)
+	exportingDirs    = make(map[string]bool)
+	exportsDirsMutex sync.Mutex
+)
+
+// resetExports forgets the directories visited by a previous run.
+func resetExports() {
+	exportsDirsMutex.Lock()
+	defer exportsDirsMutex.Unlock()
+
+	visitedDirs = make(map[string]bool)
+	exportingDirs = make(map[string]bool)
+}
+
+// recordVisit records that rules are generated for the directory.
+func recordVisit(rel string) {
+	exportsDirsMutex.Lock()
+	defer exportsDirsMutex.Unlock()
+
+	visitedDirs[rel] = true
+}
+
+// recordExports records that the directory produced its exports.
+func recordExports(rel string) {
+	exportsDirsMutex.Lock()
+	defer exportsDirsMutex.Unlock()
+
+	exportingDirs[rel] = true
+}
+
+// hasExports tells whether the package exports its files: when it was
+// visited during the run, whether it produced its exports, and otherwise
+// whether its existing BUILD file declares them.
+func hasExports(workspaceRoot string, pkg string) bool {
+	rel := strings.TrimPrefix(pkg, "//")
+
+	exportsDirsMutex.Lock()
+	visited, exporting := visitedDirs[rel], exportingDirs[rel]
+	exportsDirsMutex.Unlock()
+	if visited {
+		return exporting
+	}
+
+	for _, name := range []string{"BUILD.bazel", "BUILD"} {
+		f, err := rule.LoadFile(filepath.Join(workspaceRoot, rel, name), rel)
+		if err != nil {
+			continue
+		}
+		for _, r := range f.Rules {
+			if r.Kind() == EXPORT_RULE && r.Name() == exportsName(rel) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func parseFpTraceOutput(
+	logger *zerolog.Logger,
+	labels *labeler,
+	rootNixDerivPath string,
+	outputs *TraceOuts,
+	filter processFilter,
+	buildPackages bool,
+) (_, _ []string) {
 	if outputs == nil {
 		return
 	}
-	var isInPackage = func(pkg string, target string) bool {
-		// TODO: There has to be a better way!
-		return pathtools.HasPrefix(
-			strings.ReplaceAll(target, ":", string(os.PathSeparator)),
-			pkg,
-		)
-	}
 	var filesInRootNixDerivPackage, filesOutsideOfRootNixDerivPackage []string
 
-	rootNixDerivBazelPackage := getBazelPackage(workspaceRoot, rootNixDerivPath)
-	for _, output := range *outputs {
+	rootNixDerivBazelPackage := getBazelPackage(labels.workspaceRoot, rootNixDerivPath, buildPackages)
+	// Files read several times, or by several processes, are listed once
+	seen := make(map[string]bool)
+	var addInput = func(filePath string, bazelTarget string) {
+		direct := false
+		if labels.isSource(filePath) {
+			pkg := strings.SplitN(bazelTarget, ":", 2)[0]
+			direct = pkg == rootNixDerivBazelPackage
+			// Files of a nested package are referenced through the
+			// exports of the nested package, when it has some
+			if isSubPackage(rootNixDerivBazelPackage, pkg) && hasExports(labels.workspaceRoot, pkg) {
+				bazelTarget = exportsLabel(pkg)
+			}
+		}
+
+		if seen[bazelTarget] {
+			return
+		}
+		seen[bazelTarget] = true
+
+		if direct {
+			filesInRootNixDerivPackage = append(filesInRootNixDerivPackage, bazelTarget)
+		} else {
+			filesOutsideOfRootNixDerivPackage = append(filesOutsideOfRootNixDerivPackage, bazelTarget)
+		}
+	}
+
+	readsGit := false
+	tree := newProcessTree(outputs)
+	for i := range *outputs {
+		output := &(*outputs)[i]
+		if !filter.keeps(tree, output) {
+			logger.Debug().
+				Str("process", tree.lineage(output)).
+				Int("inputs", len(output.Inputs)).
+				Msg("dropping inputs of filtered process")
+			continue
+		}
+
 		for _, filePath := range output.Inputs {
-			// Skip parsing files outside of Bazel workspace
-			if !pathtools.HasPrefix(filePath, workspaceRoot) {
+			// Reads of git internals are replaced with the git-tracked
+			// files they stand for
+			if isGitPath(filePath) {
+				readsGit = true
+				continue
+			}
+
+			// Directories, whose listings were read or probed, cannot
+			// be referred to by labels
+			if isDirectory(filePath) {
+				continue
+			}
+
+			// Skip parsing files outside of Bazel workspace, and of
+			// known external repositories
+			bazelTarget, ok := labels.label(filePath, buildPackages)
+			if !ok {
+				continue
+			}
+
+			logger.Trace().
+				Str("process", tree.lineage(output)).
+				Str("input", bazelTarget).
+				Msg("attributing input")
+			addInput(filePath, bazelTarget)
+		}
+	}
+
+	if readsGit {
+		for _, dir := range gitDirectories(outputs, filepath.Dir(rootNixDerivPath)) {
+			files, err := listGitTracked(dir)
+			if err != nil {
+				logger.Warn().
+					Err(err).
+					Str("dir", dir).
+					Msg("cannot list git-tracked files")
 				continue
 			}
 
-			bazelTarget := getBazelTarget(workspaceRoot, filePath)
-			if isInPackage(rootNixDerivBazelPackage, bazelTarget) {
-				filesInRootNixDerivPackage = append(filesInRootNixDerivPackage, bazelTarget)
-			} else {
-				filesOutsideOfRootNixDerivPackage = append(filesOutsideOfRootNixDerivPackage, bazelTarget)
+			logger.Debug().
+				Str("dir", dir).
+				Int("files", len(files)).
+				Msg("replacing reads of git internals with git-tracked files")
+			for _, filePath := range files {
+				if bazelTarget, ok := labels.label(filePath, buildPackages); ok {
+					addInput(filePath, bazelTarget)
+				}
 			}
 		}
 	}
@@ -154,13 +320,16 @@ func parseFpTraceOutput(workspaceRoot string, rootNixDerivPath string, outputs *
 	return filesInRootNixDerivPackage, filesOutsideOfRootNixDerivPackage
 }
 
-func nixToDepSets(logger *zerolog.Logger, nixPrelude, nixPath, nixFile, nixAttrPath string) (_, _ []string, err error) {
-	// TODO: Lookupenv
-	wsroot := os.Getenv("BUILD_WORKSPACE_DIRECTORY")
-
+func nixToDepSets(
+	logger *zerolog.Logger,
+	workspaceRoot string,
+	nixCfg *nixconfig.NixLanguageConfig,
+	nixFile string,
+	target evalTarget,
+) (_, _ []string, err error) {
 	le := &LogEvent{
 		Path:    nixFile,
-		Runfile: FPTRACE_PATH,
+		Runfile: string(nixCfg.Tracer),
 	}
 
 	defer err2.Handle(&err, func() {
@@ -169,56 +338,126 @@ func nixToDepSets(logger *zerolog.Logger, nixPrelude, nixPath, nixFile, nixAttrP
 	})
 
 	// TODO: distinguish between fatal/non fatal errors
-	pathToFpTrace := try.To1(bazel.Runfile(FPTRACE_PATH))
-	tmpfile := try.To1(ioutil.TempFile("", "nix-gzl*.json"))
-
-	defer tmpfile.Close()
-	defer os.Remove(tmpfile.Name())
-
-	nixInstantiatePreludeParams := ""
-	nixInstantiateArgument := nixFile
-	if len(nixPrelude) > 0 {
-		// Thank you golang, that I may not name string formating params, that makes things so much more readable
-		// Should use: os.PathSeparator
-		// <workspace-root-path>/<nix-prelude-file> -A
-		nixInstantiatePreludeParams = fmt.Sprintf("%s/%s -A ", wsroot, nixPrelude)
-		nixInstantiateArgument = nixAttrPath
-	}
-
-	// Thank you golang, that I may not name string formating params, that makes things so much more readable
-	// -d <tmp-dir-path> nix-instantiate <nixPrelude><path-to-nix-file>
-	var fpTraceParams = fmt.Sprintf(
-		"-d %s nix-instantiate %s%s -I %s",
-		tmpfile.Name(),
-		nixInstantiatePreludeParams,
-		nixInstantiateArgument,
-		os.ExpandEnv(nixPath),
-	)
+	t := try.To1(newTracer(nixCfg.Tracer, nixCfg.TracerPath))
+	le.Runfile = t.path()
 
-	var outputBuf bytes.Buffer
-	cmd := exec.Command(
-		pathToFpTrace,
-		strings.Split(fpTraceParams, " ")...,
-	)
-	cmd.Stdout = &outputBuf
-	cmd.Stderr = &outputBuf
+	env := try.To1(newEvalEnvironment(nixCfg))
+	defer env.Close()
 
-	defer err2.Handle(&err, func() {
-		le.Details = outputBuf.Bytes()
-		le.Command = strings.Join(cmd.Args, " ")
-		le.SetMessage("evaluation of nix expression failed")
-	})
-	try.To(cmd.Run())
+	ev := try.To1(newEvaluator(workspaceRoot, nixCfg))
+	logger.Trace().
+		Str("package", nixFile).
+		Stringer("evaluator", ev).
+		Msg("evaluating")
 
-	defer err2.Handle(&err, func() {
-		le.Tracefile = tmpfile.Name()
-		le.SetMessage("unmarshaling of trace output failed")
-	})
-	byteValue := try.To1(os.ReadFile(tmpfile.Name()))
+	command := newEvalCommand(workspaceRoot, nixCfg, ev, target)
 
+	var cacheKey string
 	var traceOuts TraceOuts
-	try.To(json.Unmarshal(byteValue, &traceOuts))
+	var ifdDrvs []string
+	cached := false
+	if nixCfg.CacheDir != "" {
+		cacheKey = traceCacheKey(
+			t,
+			append(
+				command.args,
+				ev.String(),
+				strconv.FormatBool(nixCfg.ReadOnlyWorkspace),
+				string(nixCfg.IFDPolicy),
+				strconv.FormatBool(nixCfg.IFDProbe),
+			),
+			env.stableEnv(),
+		)
+		var entry *traceCacheEntry
+		if entry, cached = loadTraceCache(nixCfg.CacheDir, cacheKey); cached {
+			logger.Debug().
+				Str("package", nixFile).
+				Msg("using cached trace")
+			traceOuts, ifdDrvs = entry.Trace, entry.IFD
+		}
+	}
+
+	if !cached {
+		tmpfile := try.To1(ioutil.TempFile("", "nix-gzl*.trace"))
+
+		defer tmpfile.Close()
+		defer os.Remove(tmpfile.Name())
+
+		command.traced(t, tmpfile.Name())
+		if nixCfg.ReadOnlyWorkspace {
+			command.args = try.To1(readOnlyWorkspace(workspaceRoot, command.args))
+		}
+
+		var outputBuf bytes.Buffer
+		cmd, runErr := command.run(env, nixCfg.Timeout, &outputBuf, &outputBuf)
+
+		defer err2.Handle(&err, func() {
+			reportMissingSearchPaths(logger, workspaceRoot, nixFile, outputBuf.Bytes())
+			reportRestrictedAccesses(logger, workspaceRoot, nixFile, outputBuf.Bytes())
+			reportDisabledIFD(logger, nixFile, outputBuf.Bytes())
+			le.Details = outputBuf.Bytes()
+			le.Command = strings.Join(cmd.Args, " ")
+			le.SetMessage("evaluation of nix expression failed")
+		})
+		try.To(runErr)
+
+		defer err2.Handle(&err, func() {
+			le.Tracefile = tmpfile.Name()
+			le.SetMessage("unmarshaling of trace output failed")
+		})
+		traceOuts = try.To1(t.parse(tmpfile.Name()))
+
+		ifdDrvs = ifdFromTrace(&traceOuts, filepath.Base(ev.binary), os.ReadFile)
+		if len(ifdDrvs) == 0 && nixCfg.IFDPolicy == nixconfig.POLICY_WARN && nixCfg.IFDProbe {
+			ifdDrvs = probeIFD(workspaceRoot, nixCfg, ev, env, target)
+		}
+
+		if nixCfg.CacheDir != "" {
+			if err := storeTraceCache(nixCfg.CacheDir, cacheKey, traceOuts, ifdDrvs); err != nil {
+				logger.Warn().
+					Err(err).
+					Str("package", nixFile).
+					Msg("cannot cache trace")
+			}
+		}
+	}
+
+	filter := processFilter{
+		allow: nixCfg.TraceAllow,
+		deny:  nixCfg.TraceDeny,
+	}
+	labels := getLabeler(workspaceRoot)
+	directDeps, externalDeps := parseFpTraceOutput(
+		logger,
+		labels,
+		nixFile,
+		&traceOuts,
+		filter,
+		usesBuildPackages(nixCfg),
+	)
+	logger.Debug().
+		Str("package", nixFile).
+		Strs("entries", resolvedSearchPaths(workspaceRoot, nixCfg.NixSearchPath, &traceOuts)).
+		Msg("resolved search path entries")
+
+	defer err2.Handle(&err, func() {
+		le.SetMessage("evaluation is not hermetic")
+	})
+	try.To(reportWrites(
+		logger,
+		nixCfg.WritePolicy,
+		nixFile,
+		findWrites(workspaceRoot, nixCfg.SensitivePaths, &traceOuts),
+	))
+	externalInputs := collectExternalInputs(labels, &traceOuts, filter)
+	try.To(reportExternalInputs(logger, nixCfg, nixFile, externalInputs))
+	try.To(reportIFD(
+		logger,
+		nixCfg.IFDPolicy,
+		nixFile,
+		storePathsOf(externalInputs),
+		ifdDrvs,
+	))
 
-	directDeps, externalDeps := parseFpTraceOutput(wsroot, nixFile, &traceOuts)
 	return directDeps, externalDeps, nil
 }
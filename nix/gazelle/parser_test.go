@@ -0,0 +1,165 @@
+package gazelle
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestParseFpTraceOutputDeduplicates(t *testing.T) {
+	workspaceRoot := writeWorkspace(t, map[string]string{
+		"WORKSPACE":            "",
+		"pkg/default.nix":      "",
+		"pkg/src/main.c":       "",
+		"lib/BUILD.bazel":      "",
+		"lib/default.nix":      "",
+		"lib/helpers/util.nix": "",
+	})
+	join := func(rel string) string {
+		return filepath.Join(workspaceRoot, rel)
+	}
+
+	outputs := TraceOuts{
+		{
+			Cmd:    TraceCmd{ID: 1, Path: "/bin/nix-instantiate"},
+			Inputs: []string{join("pkg/default.nix"), join("lib/default.nix"), join("pkg/default.nix")},
+		},
+		{
+			Cmd:    TraceCmd{ID: 2, Parent: 1, Path: "/bin/sh"},
+			Inputs: []string{join("pkg/src/main.c"), join("lib/default.nix")},
+		},
+	}
+
+	logger := zerolog.Nop()
+	direct, external := parseFpTraceOutput(
+		&logger,
+		getLabeler(workspaceRoot),
+		join("pkg/default.nix"),
+		&outputs,
+		processFilter{},
+		false,
+	)
+
+	if want := []string{"//pkg:default.nix", "//pkg:src/main.c"}; !equalStrings(direct, want) {
+		t.Errorf("direct = %q, want %q", direct, want)
+	}
+	if want := []string{"//lib:default.nix"}; !equalStrings(external, want) {
+		t.Errorf("external = %q, want %q", external, want)
+	}
+}
+
+func TestIsSubPackage(t *testing.T) {
+	tests := []struct {
+		parent string
+		child  string
+		want   bool
+	}{
+		{parent: "//pkg", child: "//pkg/sub", want: true},
+		{parent: "//pkg", child: "//pkg/sub/nested", want: true},
+		{parent: "//", child: "//pkg", want: true},
+		{parent: "//pkg", child: "//pkg", want: false},
+		{parent: "//pkg", child: "//pkgs/sub", want: false},
+		{parent: "//pkg/sub", child: "//pkg", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isSubPackage(tt.parent, tt.child); got != tt.want {
+			t.Errorf("isSubPackage(%q, %q) = %t, want %t", tt.parent, tt.child, got, tt.want)
+		}
+	}
+}
+
+func TestExportsLabel(t *testing.T) {
+	tests := []struct {
+		pkg  string
+		want string
+	}{
+		{pkg: "//pkg", want: "//pkg:pkg-exports"},
+		{pkg: "//folks/cowsay", want: "//folks/cowsay:folks.cowsay-exports"},
+	}
+
+	for _, tt := range tests {
+		if got := exportsLabel(tt.pkg); got != tt.want {
+			t.Errorf("exportsLabel(%q) = %q, want %q", tt.pkg, got, tt.want)
+		}
+	}
+}
+
+func TestNestedPackageInputs(t *testing.T) {
+	tests := []struct {
+		name   string
+		record func()
+		build  string
+		want   string
+	}{
+		{
+			name: "exports produced during the run",
+			record: func() {
+				recordVisit("pkg/sub")
+				recordExports("pkg/sub")
+			},
+			want: "//pkg/sub:pkg.sub-exports",
+		},
+		{
+			name: "package skipped during the run",
+			record: func() {
+				recordVisit("pkg/sub")
+			},
+			build: "filegroup(name = \"pkg.sub-exports\")\n",
+			want:  "//pkg/sub:default.nix",
+		},
+		{
+			name:  "exports declared by a package not visited",
+			build: "filegroup(name = \"pkg.sub-exports\")\n",
+			want:  "//pkg/sub:pkg.sub-exports",
+		},
+		{
+			name: "no exports",
+			want: "//pkg/sub:default.nix",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetExports()
+			defer resetExports()
+
+			files := map[string]string{
+				"WORKSPACE":           "",
+				"pkg/default.nix":     "",
+				"pkg/sub/default.nix": "",
+			}
+			if tt.build != "" {
+				files["pkg/sub/BUILD.bazel"] = tt.build
+			}
+			workspaceRoot := writeWorkspace(t, files)
+			if tt.record != nil {
+				tt.record()
+			}
+
+			outputs := TraceOuts{
+				{
+					Cmd: TraceCmd{ID: 1, Path: "/bin/nix-instantiate"},
+					Inputs: []string{
+						filepath.Join(workspaceRoot, "pkg/default.nix"),
+						filepath.Join(workspaceRoot, "pkg/sub/default.nix"),
+					},
+				},
+			}
+
+			logger := zerolog.Nop()
+			_, external := parseFpTraceOutput(
+				&logger,
+				getLabeler(workspaceRoot),
+				filepath.Join(workspaceRoot, "pkg/default.nix"),
+				&outputs,
+				processFilter{},
+				false,
+			)
+			if want := []string{tt.want}; !equalStrings(external, want) {
+				t.Errorf("external = %q, want %q", external, want)
+			}
+		})
+	}
+}
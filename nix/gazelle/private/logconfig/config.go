@@ -1,6 +1,7 @@
 package logconfig
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"regexp"
@@ -20,11 +21,19 @@ const (
 
 	GAZELLE_NIX_LOGGING_LEVEL = "GAZELLE_LANGUAGES_NIX_LOG_LEVEL"
 	DEFAULT_LOGGING_LEVEL     = "info"
+
+	LOG_FORMAT_CONSOLE = "console"
+	LOG_FORMAT_JSON    = "json"
 )
 
+var errLogFormat = errors.New("unknown log format, expected one of: console, json")
+
 var loggerInstance *zerolog.Logger
 var once sync.Once
 
+// format is the current format of the logs, as last set by SetFormat.
+var format = LOG_FORMAT_CONSOLE
+
 func getLoggingLevel() zerolog.Level {
 	var verbosity string
 	zerolog.ErrorStackMarshaler = pkgerrors.MarshalStack
@@ -129,3 +138,29 @@ func stackTraceHook(re *regexp.Regexp, details []*string) zerolog.HookFunc {
 		e.Discard()
 	}
 }
+
+// SetFormat switches the output of the logger between human readable
+// console output, and one JSON object per line.
+func SetFormat(newFormat string) error {
+	logger := GetLogger()
+
+	switch newFormat {
+	case LOG_FORMAT_CONSOLE:
+		*logger = logger.Output(zerolog.ConsoleWriter{
+			Out:          os.Stderr,
+			PartsExclude: []string{"time"},
+		})
+	case LOG_FORMAT_JSON:
+		*logger = logger.Output(os.Stderr)
+	default:
+		return errLogFormat
+	}
+	format = newFormat
+
+	return nil
+}
+
+// Format returns the current format of the logs.
+func Format() string {
+	return format
+}
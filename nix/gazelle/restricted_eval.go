@@ -0,0 +1,114 @@
+package gazelle
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/pathtools"
+	"github.com/rs/zerolog"
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+var (
+	// restrictedAccessRegex matches the errors reported by the evaluator
+	// when restricted evaluation denies access to a path or to an URI.
+	restrictedAccessRegex = regexp.MustCompile(
+		`access to (?:absolute )?(path|URI) '([^']+)' is forbidden in restricted mode`,
+	)
+	// evalLocationRegex matches source locations in evaluation traces.
+	evalLocationRegex = regexp.MustCompile(`at (/[^\s:,]+):(\d+):(\d+)`)
+)
+
+// RESTRICTED_WORKSPACE_ENTRY names the search path entry granting
+// restricted evaluation access to the workspace. Angle bracket lookups
+// cannot express it, so that <foo> never resolves to a directory of the
+// workspace, unlike with a nameless entry.
+const RESTRICTED_WORKSPACE_ENTRY = "gazelle:workspace"
+
+// restrictedEvalArgs returns the evaluator arguments enabling restricted
+// evaluation, where only the workspace, the configured repositories and
+// the allowed URIs can be accessed. Restricted evaluation only grants
+// access to the paths of search path entries.
+func restrictedEvalArgs(workspaceRoot string, nixCfg *nixconfig.NixLanguageConfig) []string {
+	if !nixCfg.RestrictEval {
+		return nil
+	}
+
+	args := []string{
+		"--option", "restrict-eval", "true",
+		"-I", RESTRICTED_WORKSPACE_ENTRY + "=" + workspaceRoot,
+	}
+	if len(nixCfg.AllowedURIs) > 0 {
+		args = append(args, "--option", "allowed-uris", strings.Join(nixCfg.AllowedURIs, " "))
+	}
+
+	return args
+}
+
+// restrictedAccess is an access denied by restricted evaluation, along
+// with the location of the expression which attempted it, if known.
+type restrictedAccess struct {
+	kind     string
+	target   string
+	location string
+}
+
+// findRestrictedAccesses extracts the access violations from the output
+// of the evaluator. The location of a violation is the one reported on
+// the same line, or the closest one preceding it in the trace.
+func findRestrictedAccesses(workspaceRoot string, evaluatorOutput []byte) []restrictedAccess {
+	var accesses []restrictedAccess
+	var lastLocation string
+
+	for _, line := range strings.Split(string(evaluatorOutput), "\n") {
+		locations := evalLocationRegex.FindAllStringSubmatch(line, -1)
+		match := restrictedAccessRegex.FindStringSubmatch(line)
+
+		if match != nil {
+			location := lastLocation
+			if len(locations) > 0 {
+				location = formatLocation(workspaceRoot, locations[len(locations)-1])
+			}
+			accesses = append(accesses, restrictedAccess{
+				kind:     strings.ToLower(match[1]),
+				target:   match[2],
+				location: location,
+			})
+		}
+
+		if len(locations) > 0 {
+			lastLocation = formatLocation(workspaceRoot, locations[len(locations)-1])
+		}
+	}
+
+	return accesses
+}
+
+func formatLocation(workspaceRoot string, match []string) string {
+	file := match[1]
+	if pathtools.HasPrefix(file, workspaceRoot) {
+		file = "//" + pathtools.TrimPrefix(file, workspaceRoot)
+	}
+
+	return fmt.Sprintf("%s:%s:%s", file, match[2], match[3])
+}
+
+// reportRestrictedAccesses logs a diagnostic for every access denied by
+// restricted evaluation.
+func reportRestrictedAccesses(
+	logger *zerolog.Logger,
+	workspaceRoot string,
+	nixFile string,
+	evaluatorOutput []byte,
+) {
+	for _, access := range findRestrictedAccesses(workspaceRoot, evaluatorOutput) {
+		event := logger.Error().
+			Str("package", nixFile).
+			Str(access.kind, access.target)
+		if access.location != "" {
+			event = event.Str("location", access.location)
+		}
+		event.Msgf("restricted evaluation denied access to %s", access.kind)
+	}
+}
@@ -0,0 +1,25 @@
+package gazelle
+
+import (
+	"testing"
+
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+func TestRestrictedEvalArgs(t *testing.T) {
+	nixCfg := nixconfig.New()
+	if args := restrictedEvalArgs("/ws", nixCfg); args != nil {
+		t.Errorf("restrictedEvalArgs() = %q without restricted evaluation, want nil", args)
+	}
+
+	nixCfg.RestrictEval = true
+	nixCfg.AllowedURIs = []string{"https://github.com/", "https://example.com/"}
+	want := []string{
+		"--option", "restrict-eval", "true",
+		"-I", "gazelle:workspace=/ws",
+		"--option", "allowed-uris", "https://github.com/ https://example.com/",
+	}
+	if got := restrictedEvalArgs("/ws", nixCfg); !equalStrings(got, want) {
+		t.Errorf("restrictedEvalArgs() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,117 @@
+package gazelle
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/pathtools"
+	"github.com/rs/zerolog"
+)
+
+// missingSearchPathRegex matches the error reported by the evaluator when
+// an angle bracket lookup, such as <foo> or <foo/bar.nix>, cannot be
+// resolved.
+var missingSearchPathRegex = regexp.MustCompile(
+	`file '([^']+)' was not found in the Nix search path`,
+)
+
+// searchPathEntries returns the configured search path as sorted
+// <name>=<absolute path> entries.
+func searchPathEntries(workspaceRoot string, searchPath map[string]string) []string {
+	entries := make([]string, 0, len(searchPath))
+	for name, path := range searchPath {
+		entries = append(entries, fmt.Sprintf("%s=%s", name, filepath.Join(workspaceRoot, path)))
+	}
+	sort.Strings(entries)
+
+	return entries
+}
+
+// resolvedSearchPaths returns the names of the configured search path
+// entries whose files were read during evaluation. An entry pointing to
+// a file is only resolved by reads of that very file, and an entry
+// pointing to a directory by reads of anything below it.
+func resolvedSearchPaths(
+	workspaceRoot string,
+	searchPath map[string]string,
+	outputs *TraceOuts,
+) []string {
+	if outputs == nil {
+		return nil
+	}
+
+	var resolved []string
+	for name, path := range searchPath {
+		entryPath := filepath.Join(workspaceRoot, path)
+		isFile := fileExists(entryPath)
+
+	search:
+		for _, output := range *outputs {
+			for _, filePath := range output.Inputs {
+				if filePath == entryPath || (!isFile && pathtools.HasPrefix(filePath, entryPath)) {
+					resolved = append(resolved, name)
+					break search
+				}
+			}
+		}
+	}
+	sort.Strings(resolved)
+
+	return resolved
+}
+
+// missingSearchPaths returns the names of the search path entries the
+// evaluator failed to resolve, according to its output.
+func missingSearchPaths(evaluatorOutput []byte) []string {
+	seen := make(map[string]bool)
+
+	var missing []string
+	for _, match := range missingSearchPathRegex.FindAllSubmatch(evaluatorOutput, -1) {
+		name := strings.SplitN(string(match[1]), "/", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			missing = append(missing, name)
+		}
+	}
+
+	return missing
+}
+
+// suggestRepository proposes a nix_repositories entry for an unconfigured
+// search path entry, based on where the ambient NIX_PATH would have
+// resolved it.
+func suggestRepository(workspaceRoot string, name string) string {
+	path := "<path>"
+	for _, entry := range filepath.SplitList(os.Getenv("NIX_PATH")) {
+		nameAndPath := strings.SplitN(entry, "=", 2)
+		if len(nameAndPath) == 2 && nameAndPath[0] == name {
+			if pathtools.HasPrefix(nameAndPath[1], workspaceRoot) {
+				path = pathtools.TrimPrefix(nameAndPath[1], workspaceRoot)
+			}
+			break
+		}
+	}
+
+	return fmt.Sprintf("# gazelle:nix_repositories %s=@%s=%s", name, name, path)
+}
+
+// reportMissingSearchPaths logs an error, along with a suggested
+// directive, for every lookup of an unconfigured search path entry.
+func reportMissingSearchPaths(
+	logger *zerolog.Logger,
+	workspaceRoot string,
+	nixFile string,
+	evaluatorOutput []byte,
+) {
+	for _, name := range missingSearchPaths(evaluatorOutput) {
+		logger.Error().
+			Str("package", nixFile).
+			Str("entry", name).
+			Str("suggestion", suggestRepository(workspaceRoot, name)).
+			Msgf("<%s> is not configured in nix_repositories", name)
+	}
+}
@@ -0,0 +1,69 @@
+package gazelle
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvedSearchPaths(t *testing.T) {
+	workspaceRoot := t.TempDir()
+	for _, dir := range []string{"nix/nixpkgs", "nix/overlays"} {
+		if err := os.MkdirAll(filepath.Join(workspaceRoot, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"nix/nixpkgs/default.nix", "nix/sources.nix", "nix/other.nix"} {
+		if err := os.WriteFile(filepath.Join(workspaceRoot, file), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	searchPath := map[string]string{
+		"nixpkgs":  "nix/nixpkgs",
+		"overlays": "nix/overlays",
+		"sources":  "nix/sources.nix",
+	}
+
+	tests := []struct {
+		name   string
+		inputs []string
+		want   []string
+	}{
+		{
+			name:   "file below a directory entry",
+			inputs: []string{"nix/nixpkgs/default.nix"},
+			want:   []string{"nixpkgs"},
+		},
+		{
+			name:   "file entry",
+			inputs: []string{"nix/sources.nix"},
+			want:   []string{"sources"},
+		},
+		{
+			name:   "sibling of a file entry",
+			inputs: []string{"nix/other.nix"},
+			want:   nil,
+		},
+		{
+			name:   "directory entry itself",
+			inputs: []string{"nix/overlays"},
+			want:   []string{"overlays"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inputs []string
+			for _, input := range tt.inputs {
+				inputs = append(inputs, filepath.Join(workspaceRoot, input))
+			}
+			outputs := TraceOuts{{Cmd: TraceCmd{ID: 1}, Inputs: inputs}}
+
+			got := resolvedSearchPaths(workspaceRoot, searchPath, &outputs)
+			if !equalStrings(got, tt.want) {
+				t.Errorf("resolvedSearchPaths() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package gazelle
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// processTree indexes traced processes by their id, so that every trace
+// entry can be attributed to the process, and the chain of parents,
+// that produced it.
+type processTree map[int]*TraceProcess
+
+func newProcessTree(outputs *TraceOuts) processTree {
+	tree := make(processTree, len(*outputs))
+	for i := range *outputs {
+		process := &(*outputs)[i]
+		tree[process.Cmd.ID] = process
+	}
+
+	return tree
+}
+
+// ancestors returns the process itself followed by its parents, ordered
+// from the closest to the most distant one.
+func (t processTree) ancestors(process *TraceProcess) []*TraceProcess {
+	chain := []*TraceProcess{process}
+	seen := map[int]bool{process.Cmd.ID: true}
+
+	for current := process; ; {
+		parent, ok := t[current.Cmd.Parent]
+		if !ok || seen[parent.Cmd.ID] {
+			return chain
+		}
+		seen[parent.Cmd.ID] = true
+		chain = append(chain, parent)
+		current = parent
+	}
+}
+
+// lineage renders the process and its parents, e.g.
+// "bash[14] < nix-instantiate[12]".
+func (t processTree) lineage(process *TraceProcess) string {
+	chain := t.ancestors(process)
+	parts := make([]string, 0, len(chain))
+	for _, p := range chain {
+		parts = append(parts, fmt.Sprintf("%s[%d]", processName(p), p.Cmd.ID))
+	}
+
+	return strings.Join(parts, " < ")
+}
+
+func processName(process *TraceProcess) string {
+	if process.Cmd.Path != "" {
+		return filepath.Base(process.Cmd.Path)
+	}
+	if len(process.Cmd.Args) > 0 {
+		return filepath.Base(process.Cmd.Args[0])
+	}
+
+	return "?"
+}
+
+// processFilter decides which traced processes contribute their inputs
+// to the dependency sets. Rules are glob patterns matched against the
+// base name of the executable.
+//
+// A process is dropped if it, or any of its parents, matches a deny
+// rule. When allow rules are present, a process is only kept if it
+// matches one of them itself, so that allowing `nix-instantiate` keeps
+// the evaluator's own reads, but not those of its helpers.
+type processFilter struct {
+	allow []string
+	deny  []string
+}
+
+func (f processFilter) keeps(tree processTree, process *TraceProcess) bool {
+	for _, p := range tree.ancestors(process) {
+		if matchesAny(f.deny, processName(p)) {
+			return false
+		}
+	}
+
+	if len(f.allow) == 0 {
+		return true
+	}
+
+	return matchesAny(f.allow, processName(process))
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,78 @@
+package gazelle
+
+import (
+	"testing"
+)
+
+// traceProcesses is a nix-instantiate evaluation, spawning a shell which
+// runs git, and a process whose parent is its own child, as reported by
+// a tracer which reused a process id.
+var traceProcesses = TraceOuts{
+	{Cmd: TraceCmd{ID: 1, Path: "/bin/nix-instantiate"}},
+	{Cmd: TraceCmd{ID: 2, Parent: 1, Path: "/bin/bash"}},
+	{Cmd: TraceCmd{ID: 3, Parent: 2, Path: "/usr/bin/git"}},
+	{Cmd: TraceCmd{ID: 4, Parent: 5, Args: []string{"/bin/loop"}}},
+	{Cmd: TraceCmd{ID: 5, Parent: 4}},
+}
+
+func TestProcessTreeAncestors(t *testing.T) {
+	outputs := traceProcesses
+	tree := newProcessTree(&outputs)
+
+	tests := []struct {
+		id   int
+		want string
+	}{
+		{id: 1, want: "nix-instantiate[1]"},
+		{id: 3, want: "git[3] < bash[2] < nix-instantiate[1]"},
+		{id: 4, want: "loop[4] < ?[5]"},
+	}
+
+	for _, tt := range tests {
+		if got := tree.lineage(tree[tt.id]); got != tt.want {
+			t.Errorf("lineage(%d) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestProcessFilterKeeps(t *testing.T) {
+	outputs := traceProcesses
+	tree := newProcessTree(&outputs)
+
+	tests := []struct {
+		name   string
+		filter processFilter
+		want   map[int]bool
+	}{
+		{
+			name:   "no rules",
+			filter: processFilter{},
+			want:   map[int]bool{1: true, 2: true, 3: true},
+		},
+		{
+			name:   "deny applies to descendants",
+			filter: processFilter{deny: []string{"ba*"}},
+			want:   map[int]bool{1: true, 2: false, 3: false},
+		},
+		{
+			name:   "allow applies to the process only",
+			filter: processFilter{allow: []string{"nix-*"}},
+			want:   map[int]bool{1: true, 2: false, 3: false},
+		},
+		{
+			name:   "deny wins over allow",
+			filter: processFilter{allow: []string{"git"}, deny: []string{"bash"}},
+			want:   map[int]bool{1: false, 2: false, 3: false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for id, want := range tt.want {
+				if got := tt.filter.keeps(tree, tree[id]); got != want {
+					t.Errorf("keeps(%s) = %t, want %t", tree.lineage(tree[id]), got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package gazelle
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel"
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+// tracer records the processes spawned by an evaluation, and the files
+// they access.
+type tracer interface {
+	// path returns the path of the tracer binary.
+	path() string
+	// wrap returns the command tracing args, and writing its report to
+	// traceFile.
+	wrap(args []string, traceFile string) []string
+	// parse reads the report written to traceFile.
+	parse(traceFile string) (TraceOuts, error)
+}
+
+var errTracerNotFound = errors.New("cannot find the tracer")
+
+// newTracer locates the binary of the tracing backend: the configured
+// path, if any, or else the binary of the backend found in PATH, or else
+// in the runfiles, when running through bazel run.
+func newTracer(backend nixconfig.Tracer, tracerPath string) (tracer, error) {
+	binary, err := findTracer(backend, tracerPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if backend == nixconfig.TRACER_STRACE {
+		return &straceTracer{binary: binary}, nil
+	}
+	return &fptraceTracer{binary: binary}, nil
+}
+
+func findTracer(backend nixconfig.Tracer, tracerPath string) (string, error) {
+	if tracerPath != "" {
+		if _, err := os.Stat(tracerPath); err != nil {
+			return "", fmt.Errorf("%w: %s: %v", errTracerNotFound, backend, err)
+		}
+		return tracerPath, nil
+	}
+
+	if binary, err := exec.LookPath(string(backend)); err == nil {
+		return binary, nil
+	}
+
+	if backend == nixconfig.TRACER_FPTRACE {
+		if binary, err := bazel.Runfile(FPTRACE_PATH); err == nil {
+			return binary, nil
+		}
+	}
+
+	return "", fmt.Errorf(
+		"%w: %s is neither set with -%s, nor found in PATH, nor in the runfiles",
+		errTracerNotFound,
+		backend,
+		FLAG_TRACER_PATH,
+	)
+}
+
+// fptraceTracer traces with fptrace, which writes its report as JSON.
+type fptraceTracer struct {
+	binary string
+}
+
+func (t *fptraceTracer) path() string {
+	return t.binary
+}
+
+func (t *fptraceTracer) wrap(args []string, traceFile string) []string {
+	return append([]string{t.binary, "-d", traceFile}, args...)
+}
+
+func (t *fptraceTracer) parse(traceFile string) (TraceOuts, error) {
+	byteValue, err := os.ReadFile(traceFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var traceOuts TraceOuts
+	if err := json.Unmarshal(byteValue, &traceOuts); err != nil {
+		return nil, err
+	}
+
+	return traceOuts, nil
+}
+
+// STRACE_SYSCALLS are the system calls recorded by strace: those
+// spawning processes, and those accessing files, including the probes
+// of pathExists, readDir or readFileType. Classes are used, as the
+// system calls available differ between architectures.
+const STRACE_SYSCALLS = "trace=%file,%process,chdir"
+
+var (
+	// straceLineRegex matches a completed system call of a strace report,
+	// capturing the pid, the system call, its arguments, its result, and
+	// the error of a failed call.
+	straceLineRegex = regexp.MustCompile(`^(\d+)\s+(\w+)\((.*)\)\s+=\s+(-?\d+|\?)(?:\s+(E[A-Z]+))?`)
+	// straceUnfinishedRegex matches a system call interrupted by another
+	// process, and straceResumedRegex its continuation.
+	straceUnfinishedRegex = regexp.MustCompile(`^(\d+)\s+(.*) <unfinished \.\.\.>$`)
+	straceResumedRegex    = regexp.MustCompile(`^(\d+)\s+<\.\.\. \w+ resumed>\s?(.*)$`)
+	// straceStringRegex matches the quoted strings of system call
+	// arguments.
+	straceStringRegex = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"`)
+	// straceDirFDRegex matches a directory file descriptor argument,
+	// decoded by strace -y, capturing the path of the directory.
+	straceDirFDRegex = regexp.MustCompile(`^\d+<([^>]*)>,`)
+)
+
+// straceReads are the system calls reading, or probing, files.
+var straceReads = map[string]bool{
+	"open": true, "openat": true, "openat2": true,
+	"stat": true, "lstat": true, "stat64": true, "lstat64": true,
+	"newfstatat": true, "fstatat64": true, "statx": true,
+	"access": true, "faccessat": true, "faccessat2": true,
+	"readlink": true, "readlinkat": true,
+	"getxattr": true, "lgetxattr": true,
+	"statfs": true, "statfs64": true,
+}
+
+// straceModifications are the system calls creating, modifying or removing
+// files. Every path they are given is an output.
+var straceModifications = map[string]bool{
+	"creat": true,
+	"mkdir": true, "mkdirat": true,
+	"rename": true, "renameat": true, "renameat2": true,
+	"unlink": true, "unlinkat": true, "rmdir": true,
+	"link": true, "linkat": true, "symlink": true, "symlinkat": true,
+	"truncate": true, "truncate64": true,
+	"chmod": true, "fchmodat": true,
+	"chown": true, "lchown": true, "fchownat": true,
+	"utime": true, "utimes": true, "utimensat": true, "futimesat": true,
+	"mknod": true, "mknodat": true,
+}
+
+// straceTracer traces with strace, which is widely available, but
+// slower than fptrace.
+type straceTracer struct {
+	binary string
+}
+
+func (t *straceTracer) path() string {
+	return t.binary
+}
+
+func (t *straceTracer) wrap(args []string, traceFile string) []string {
+	return append(
+		[]string{t.binary, "-f", "-qq", "-y", "-s", "4096", "-e", STRACE_SYSCALLS, "-o", traceFile},
+		args...,
+	)
+}
+
+// straceProcess is the state of a traced pid, while reading the report.
+type straceProcess struct {
+	process *TraceProcess
+	dir     string
+	pending string
+}
+
+func (t *straceTracer) parse(traceFile string) (TraceOuts, error) {
+	file, err := os.Open(traceFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	cwd, _ := os.Getwd()
+
+	var processes []*TraceProcess
+	pids := make(map[int]*straceProcess)
+	getPid := func(pid int) *straceProcess {
+		p, ok := pids[pid]
+		if !ok {
+			p = &straceProcess{dir: cwd}
+			pids[pid] = p
+		}
+		return p
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if match := straceUnfinishedRegex.FindStringSubmatch(line); match != nil {
+			pid, _ := strconv.Atoi(match[1])
+			getPid(pid).pending = match[2]
+			continue
+		}
+		if match := straceResumedRegex.FindStringSubmatch(line); match != nil {
+			pid, _ := strconv.Atoi(match[1])
+			p := getPid(pid)
+			line = match[1] + " " + p.pending + match[2]
+			p.pending = ""
+		}
+
+		match := straceLineRegex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		pid, _ := strconv.Atoi(match[1])
+		syscall, args, result, errno := match[2], match[3], match[4], match[5]
+		p := getPid(pid)
+		strs := straceStrings(args)
+
+		switch {
+		case strings.HasPrefix(result, "-"):
+			// A failed lookup is a negative dependency: the evaluation
+			// may change once the file exists.
+			if (errno == "ENOENT" || errno == "ENOTDIR") && straceReads[syscall] &&
+				len(strs) > 0 && p.process != nil {
+				p.process.Missing = append(p.process.Missing, straceAbs(straceDir(p.dir, args), strs[0]))
+			}
+		case syscall == "execve" || syscall == "execveat":
+			if len(strs) == 0 {
+				continue
+			}
+			parent := 0
+			if p.process != nil {
+				parent = p.process.Cmd.ID
+			}
+			p.process = &TraceProcess{Cmd: TraceCmd{
+				Parent: parent,
+				ID:     len(processes) + 1,
+				Dir:    p.dir,
+				Path:   straceAbs(straceDir(p.dir, args), strs[0]),
+				Args:   strs[1:],
+			}}
+			processes = append(processes, p.process)
+		case syscall == "clone" || syscall == "clone3" || syscall == "fork" || syscall == "vfork":
+			child, err := strconv.Atoi(result)
+			if err != nil || child <= 0 {
+				continue
+			}
+			c := getPid(child)
+			c.dir = p.dir
+			if p.process != nil {
+				// The child is the parent process, until it executes
+				// another program
+				c.process = p.process
+			}
+		case syscall == "chdir":
+			if len(strs) > 0 {
+				p.dir = straceAbs(p.dir, strs[0])
+			}
+		case straceReads[syscall]:
+			if len(strs) == 0 || p.process == nil {
+				continue
+			}
+			filePath := straceAbs(straceDir(p.dir, args), strs[0])
+			if straceWrites(args) {
+				p.process.Outputs = append(p.process.Outputs, filePath)
+			} else {
+				p.process.Inputs = append(p.process.Inputs, filePath)
+			}
+		case straceModifications[syscall]:
+			if len(strs) == 0 || p.process == nil {
+				continue
+			}
+			for _, s := range strs {
+				p.process.Outputs = append(p.process.Outputs, straceAbs(straceDir(p.dir, args), s))
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	traceOuts := make(TraceOuts, 0, len(processes))
+	for _, process := range processes {
+		traceOuts = append(traceOuts, *process)
+	}
+
+	return traceOuts, nil
+}
+
+// straceStrings returns the unquoted strings of system call arguments.
+func straceStrings(args string) []string {
+	var strs []string
+	for _, match := range straceStringRegex.FindAllString(args, -1) {
+		s, err := strconv.Unquote(match)
+		if err != nil {
+			s = match[1 : len(match)-1]
+		}
+		strs = append(strs, s)
+	}
+
+	return strs
+}
+
+// straceDir returns the directory relative paths of a system call are
+// resolved against: the directory file descriptor given as its first
+// argument, if any, or else the working directory of the process.
+func straceDir(cwd string, args string) string {
+	if match := straceDirFDRegex.FindStringSubmatch(args); match != nil {
+		return match[1]
+	}
+
+	return cwd
+}
+
+// straceWrites tells if the flags of an open system call allow writing.
+func straceWrites(args string) bool {
+	return strings.Contains(args, "O_WRONLY") ||
+		strings.Contains(args, "O_RDWR") ||
+		strings.Contains(args, "O_CREAT")
+}
+
+// straceAbs resolves a path relative to the working directory of the
+// process.
+func straceAbs(dir string, path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+
+	return filepath.Join(dir, path)
+}
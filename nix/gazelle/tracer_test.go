@@ -0,0 +1,151 @@
+package gazelle
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+)
+
+// straceReport is recorded with strace -f -qq -y, with the arguments
+// of STRACE_SYSCALLS, and trimmed down.
+const straceReport = `1000  execve("/usr/bin/nix-instantiate", ["nix-instantiate", "/ws/pkg/default.nix"], 0x7ffd2a5c8e48 /* 20 vars */) = 0
+1000  openat(AT_FDCWD, "/ws/pkg/default.nix", O_RDONLY|O_CLOEXEC) = 3</ws/pkg/default.nix>
+1000  newfstatat(AT_FDCWD, "/ws/pkg/src", {st_mode=S_IFDIR|0755, st_size=4096, ...}, 0) = 0
+1000  statx(AT_FDCWD, "/ws/pkg/missing.nix", AT_STATX_SYNC_AS_STAT, STATX_ALL, 0x7ffc6c1e5d00) = -1 ENOENT (No such file or directory)
+1000  openat(AT_FDCWD, "/ws/pkg/src", O_RDONLY|O_NONBLOCK|O_CLOEXEC|O_DIRECTORY) = 4</ws/pkg/src>
+1000  newfstatat(4</ws/pkg/src>, "main.c", {st_mode=S_IFREG|0644, st_size=120, ...}, AT_SYMLINK_NOFOLLOW) = 0
+1000  readlink("/ws/pkg/link", "target.nix", 4095) = 10
+1000  access("/ws/pkg/flag", F_OK) = 0
+1000  faccessat2(AT_FDCWD, "/ws/pkg/opt", R_OK, AT_EACCESS) = 0
+1000  clone(child_stack=NULL, flags=CLONE_CHILD_CLEARTID|CLONE_CHILD_SETTID|SIGCHLD, child_tidptr=0x7f8e1c2b5a10) = 1001
+1001  chdir("/ws/pkg") = 0
+1001  execve("/usr/bin/git", ["git", "ls-files", "-z"], 0x55d0c1b2e2a0 /* 3 vars */ <unfinished ...>
+1000  wait4(1001,  <unfinished ...>
+1001  <... execve resumed>) = 0
+1001  openat(AT_FDCWD, ".git/index", O_RDONLY) = 3</ws/pkg/.git/index>
+1001  +++ exited with 0 +++
+1000  <... wait4 resumed>[{WIFEXITED(s) && WEXITSTATUS(s) == 0}], 0, NULL) = 1001
+1000  mkdirat(AT_FDCWD, "/tmp/out", 0755) = 0
+1000  openat(AT_FDCWD, "/tmp/log", O_WRONLY|O_CREAT|O_TRUNC, 0644) = 5</tmp/log>
+1000  renameat2(AT_FDCWD, "/tmp/log", AT_FDCWD, "/tmp/log.old", RENAME_NOREPLACE) = 0
+1000  +++ exited with 0 +++
+`
+
+func TestStraceParse(t *testing.T) {
+	traceFile := filepath.Join(t.TempDir(), "trace")
+	if err := os.WriteFile(traceFile, []byte(straceReport), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := (&straceTracer{}).parse(traceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cwd, _ := os.Getwd()
+	want := TraceOuts{
+		{
+			Cmd: TraceCmd{
+				ID:   1,
+				Dir:  cwd,
+				Path: "/usr/bin/nix-instantiate",
+				Args: []string{"nix-instantiate", "/ws/pkg/default.nix"},
+			},
+			Inputs: []string{
+				"/ws/pkg/default.nix",
+				"/ws/pkg/src",
+				"/ws/pkg/src",
+				"/ws/pkg/src/main.c",
+				"/ws/pkg/link",
+				"/ws/pkg/flag",
+				"/ws/pkg/opt",
+			},
+			Missing: []string{"/ws/pkg/missing.nix"},
+			Outputs: []string{
+				"/tmp/out",
+				"/tmp/log",
+				"/tmp/log",
+				"/tmp/log.old",
+			},
+		},
+		{
+			Cmd: TraceCmd{
+				Parent: 1,
+				ID:     2,
+				Dir:    "/ws/pkg",
+				Path:   "/usr/bin/git",
+				Args:   []string{"git", "ls-files", "-z"},
+			},
+			Inputs: []string{"/ws/pkg/.git/index"},
+		},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parse() = %+v, want %+v", got, want)
+	}
+}
+
+func TestStraceDir(t *testing.T) {
+	tests := []struct {
+		args string
+		want string
+	}{
+		{args: `AT_FDCWD, "main.c", O_RDONLY`, want: "/cwd"},
+		{args: `4</ws/pkg/src>, "main.c", {st_mode=S_IFREG|0644, ...}, 0`, want: "/ws/pkg/src"},
+		{args: `"/ws/pkg/flag", F_OK`, want: "/cwd"},
+	}
+
+	for _, tt := range tests {
+		if got := straceDir("/cwd", tt.args); got != tt.want {
+			t.Errorf("straceDir(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestFindTracer(t *testing.T) {
+	pathDir := t.TempDir()
+	inPath := filepath.Join(pathDir, "strace")
+	configured := filepath.Join(t.TempDir(), "strace-static")
+	for _, binary := range []string{inPath, configured} {
+		if err := os.WriteFile(binary, nil, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		tracerPath string
+		want       string
+		err        bool
+	}{
+		{name: "configured path first", path: pathDir, tracerPath: configured, want: configured},
+		{name: "PATH", path: pathDir, want: inPath},
+		{name: "missing configured path", path: pathDir, tracerPath: configured + ".missing", err: true},
+		{name: "not found", path: t.TempDir(), err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PATH", tt.path)
+
+			got, err := findTracer(nixconfig.TRACER_STRACE, tt.tracerPath)
+			if tt.err {
+				if !errors.Is(err, errTracerNotFound) {
+					t.Fatalf("findTracer() error = %v, want %v", err, errTracerNotFound)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("findTracer() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -51,6 +51,7 @@ func collectDependenciesFromRepo(
 	lang language.Language,
 ) []*rule.Rule {
 	rules := make([]*rule.Rule, 0)
+	manifests := make(map[string][]string)
 
 	cexts := []config.Configurer{
 		&config.CommonConfigurer{},
@@ -69,14 +70,23 @@ func collectDependenciesFromRepo(
 		walk.VisitAllUpdateDirsMode,
 		func(
 			_,
-			_ string,
-			_ *config.Config,
+			rel string,
+			c *config.Config,
 			_ bool,
 			buildFile *rule.File,
 			_,
 			_,
 			_ []string,
 		) {
+			// Manifests of disabled, or ignored, directories are stale,
+			// as no rules are generated there
+			if nixCfg, err := GetNixConfig(c, rel); err == nil && (!nixCfg.Enabled || nixCfg.Ignored) {
+				logger.Debug().
+					Str("path", rel).
+					Msg("skipping the manifests of a disabled directory")
+				return
+			}
+
 			// Translate to repository rules.
 			if buildFile != nil {
 				for _, ruleStatement := range buildFile.Rules {
@@ -85,11 +95,16 @@ func collectDependenciesFromRepo(
 						// in WORKSPACE file
 						ruleStatement.SetKind(PACKAGE_RULE)
 						rules = append(rules, ruleStatement)
+						manifests[ruleStatement.Name()] = append(
+							manifests[ruleStatement.Name()],
+							buildFile.Path,
+						)
 					}
 				}
 			}
 		},
 	)
+	reportDuplicateManifests(logger, manifests)
 
 	return rules
 }
@@ -0,0 +1,75 @@
+package gazelle
+
+import (
+	"flag"
+	"sort"
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/rs/zerolog"
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/nixconfig"
+	"github.com/tweag/nix_gazelle_extension/nix/gazelle/private/logconfig"
+)
+
+func TestCollectDependenciesSkipsDisabledDirectories(t *testing.T) {
+	manifest := func(name string) string {
+		return `nixpkgs_package_manifest(
+    name = "` + name + `",
+    nix_file = "default.nix",
+)
+`
+	}
+	workspaceRoot := writeWorkspace(t, map[string]string{
+		"WORKSPACE":                     "",
+		"BUILD.bazel":                   "",
+		"kept/BUILD.bazel":              manifest("kept"),
+		"disabled/BUILD.bazel":          "# gazelle:nix_enabled false\n" + manifest("disabled"),
+		"disabled/nested/BUILD.bazel":   manifest("disabled.nested"),
+		"disabled/enabled/BUILD.bazel":  "# gazelle:nix_enabled true\n" + manifest("disabled.enabled"),
+		"ignored/.nix-ignore-directory": "",
+		"ignored/BUILD.bazel":           manifest("ignored"),
+		"ignored/nested/BUILD.bazel":    "# gazelle:nix_enabled true\n" + manifest("ignored.nested"),
+		"kept/nested/BUILD.bazel":       manifest("kept.nested"),
+	})
+
+	c := config.New()
+	c.RepoRoot = workspaceRoot
+	c.WorkDir = workspaceRoot
+	logger := zerolog.Nop()
+	rules := collectDependenciesFromRepo(&logger, c, NewLanguage())
+
+	var names []string
+	for _, r := range rules {
+		names = append(names, r.Name())
+	}
+	sort.Strings(names)
+	if want := []string{"disabled.enabled", "kept", "kept.nested"}; !equalStrings(names, want) {
+		t.Errorf("collected manifests = %q, want %q", names, want)
+	}
+}
+
+func TestUpdateReposKeepsLogFormat(t *testing.T) {
+	defer logconfig.SetFormat(logconfig.LOG_FORMAT_CONSOLE)
+
+	root := nixconfig.New()
+	var f nixFlags
+	flagSet := flag.NewFlagSet("update", flag.ContinueOnError)
+	f.register(flagSet, root)
+	if err := flagSet.Parse([]string{"-" + FLAG_LOG_FORMAT + "=json"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.apply(root); err != nil {
+		t.Fatal(err)
+	}
+
+	// update-repos registers the flags again, on a flag set it does not
+	// parse.
+	var again nixFlags
+	again.register(flag.NewFlagSet("updateReposFlagSet", flag.ContinueOnError), root)
+	if err := again.apply(root); err != nil {
+		t.Fatal(err)
+	}
+	if got := logconfig.Format(); got != logconfig.LOG_FORMAT_JSON {
+		t.Errorf("log format = %q, want %q", got, logconfig.LOG_FORMAT_JSON)
+	}
+}